@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nasa9084/go-switchbot/v4"
+)
+
+// SwitchBotClient is the part of the switchbot api the plugin uses, so that it can be replaced by a fake.
+type SwitchBotClient interface {
+	Status(ctx context.Context, id string) (switchbot.DeviceStatus, error)
+	List(ctx context.Context) ([]switchbot.Device, []switchbot.InfraredDevice, error)
+}
+
+type switchbotClient struct {
+	c        *switchbot.Client
+	recorder *ResponseRecorder
+}
+
+// NewSwitchBotClient adapts a go-switchbot client, whose requests go through recorder, to SwitchBotClient.
+func NewSwitchBotClient(c *switchbot.Client, recorder *ResponseRecorder) SwitchBotClient {
+	return switchbotClient{c: c, recorder: recorder}
+}
+
+// Status fetches the status of the device, decoding it from the raw body when go-switchbot rejects a field type.
+func (c switchbotClient) Status(ctx context.Context, id string) (switchbot.DeviceStatus, error) {
+	status, err := c.c.Device().Status(ctx, id)
+
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return status, err
+	}
+
+	raw := c.recorder.RawStatus(id)
+	if raw == nil {
+		return status, err
+	}
+
+	return DecodeStatus(raw)
+}
+
+func (c switchbotClient) List(ctx context.Context) ([]switchbot.Device, []switchbot.InfraredDevice, error) {
+	return c.c.Device().List(ctx)
+}
+
+// CallInfo records the response of a single api call, collected by ResponseRecorder through the request context.
+type CallInfo struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+type callInfoKey struct{}
+
+// WithCallInfo returns a context which makes ResponseRecorder fill the returned CallInfo.
+func WithCallInfo(ctx context.Context) (context.Context, *CallInfo) {
+	call := &CallInfo{}
+	return context.WithValue(ctx, callInfoKey{}, call), call
+}
+
+// Retryable reports whether the call is worth retrying: it got no response, was rate limited or hit a server error.
+func (c *CallInfo) Retryable() bool {
+	return c.StatusCode == 0 || c.StatusCode == http.StatusTooManyRequests || c.StatusCode >= http.StatusInternalServerError
+}
+
+// Handling of a device listed by several accounts, which is reported through the first one.
+const (
+	// DuplicatesFirst silently uses the first account listing the device.
+	DuplicatesFirst = "first"
+	// DuplicatesWarn uses the first account listing the device and logs the others (default).
+	DuplicatesWarn = "warn"
+)
+
+// MultiAccountClient is a SwitchBotClient over several switchbot accounts, listing their devices once.
+type MultiAccountClient struct {
+	Clients    []SwitchBotClient
+	Duplicates string
+
+	mu       sync.Mutex
+	listed   bool
+	devices  []switchbot.Device
+	infrared []switchbot.InfraredDevice
+	err      error
+	owners   map[string]SwitchBotClient
+}
+
+// Status fetches the status of the device from the account owning it.
+func (c *MultiAccountClient) Status(ctx context.Context, id string) (switchbot.DeviceStatus, error) {
+	owner, err := c.owner(ctx, id)
+	if err != nil {
+		return switchbot.DeviceStatus{}, err
+	}
+
+	return owner.Status(ctx, id)
+}
+
+// List returns the devices of every account once, leaving out failing accounts unless every account failed.
+func (c *MultiAccountClient) List(ctx context.Context) ([]switchbot.Device, []switchbot.InfraredDevice, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.listed || c.err != nil {
+		c.list(ctx)
+	}
+
+	return c.devices, c.infrared, c.err
+}
+
+func (c *MultiAccountClient) list(ctx context.Context) {
+	devices := []switchbot.Device{}
+	infrared := []switchbot.InfraredDevice{}
+	owners := map[string]SwitchBotClient{}
+	var errs []error
+
+	for i, client := range c.Clients {
+		d, ir, err := client.List(ctx)
+		if err != nil {
+			log.Printf("failed to list the devices of account %d: %s", i+1, err)
+			errs = append(errs, fmt.Errorf("account %d: %w", i+1, err))
+			continue
+		}
+
+		for _, device := range d {
+			if _, ok := owners[device.ID]; ok {
+				if c.Duplicates != DuplicatesFirst {
+					log.Printf("device %s is listed by account %d as well, using the first account listing it", device.ID, i+1)
+				}
+				continue
+			}
+
+			owners[device.ID] = client
+			devices = append(devices, device)
+		}
+
+		for _, remote := range ir {
+			if slices.ContainsFunc(infrared, func(r switchbot.InfraredDevice) bool { return r.ID == remote.ID }) {
+				continue
+			}
+
+			infrared = append(infrared, remote)
+		}
+	}
+
+	c.listed = true
+	c.devices, c.infrared, c.owners = devices, infrared, owners
+	c.err = nil
+	if len(errs) == len(c.Clients) {
+		c.err = errors.Join(errs...)
+	}
+}
+
+func (c *MultiAccountClient) owner(ctx context.Context, id string) (SwitchBotClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// status calls reuse the first listing even if it failed, rather than listing again for every device
+	if !c.listed {
+		c.list(ctx)
+	}
+
+	owner, ok := c.owners[id]
+	if !ok {
+		if c.err != nil {
+			return nil, fmt.Errorf("device %s: %w", id, c.err)
+		}
+		return nil, fmt.Errorf("device %s is not in any account", id)
+	}
+
+	return owner, nil
+}
+
+// NewTransport returns the transport for switchbot api calls through proxy (default: the proxy environment).
+func NewTransport(proxy string, insecure bool) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return transport, nil
+}
+
+// QuotaRemainingHeader is the response header carrying the number of api calls left for the day.
+var QuotaRemainingHeader = "X-RateLimit-Remaining"
+
+var statusPathRegexp = regexp.MustCompile(`^/v1\.1/devices/([^/]+)/status$`)
+
+// ResponseRecorder is a http.RoundTripper which records metadata of the responses from the switchbot api.
+type ResponseRecorder struct {
+	Transport http.RoundTripper
+
+	mu          sync.Mutex
+	calls       int
+	quota       int
+	quotaSeen   bool
+	serverTime  time.Time
+	localTime   time.Time
+	rawStatuses map[string]map[string]json.RawMessage
+}
+
+func (r *ResponseRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// every request counts against the daily quota, whether or not it gets a response
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if call, ok := req.Context().Value(callInfoKey{}).(*CallInfo); ok {
+		call.StatusCode = resp.StatusCode
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			call.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if remaining, err := strconv.Atoi(resp.Header.Get(QuotaRemainingHeader)); err == nil {
+		r.mu.Lock()
+		r.quota = remaining
+		r.quotaSeen = true
+		r.mu.Unlock()
+	}
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		r.mu.Lock()
+		r.serverTime = date
+		r.localTime = time.Now()
+		r.mu.Unlock()
+	}
+
+	if matches := statusPathRegexp.FindStringSubmatch(req.URL.Path); matches != nil && resp.StatusCode == http.StatusOK {
+		if err := r.recordStatus(matches[1], resp); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// recordStatus keeps the raw fields of a status response body, leaving the body readable for the switchbot client.
+func (r *ResponseRecorder) recordStatus(id string, resp *http.Response) error {
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+
+	var response struct {
+		StatusCode int                        `json:"statusCode"`
+		Body       map[string]json.RawMessage `json:"body"`
+	}
+	if err := json.Unmarshal(b, &response); err != nil || response.StatusCode != 100 {
+		// leave reporting the malformed body or the failure to the switchbot client
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rawStatuses == nil {
+		r.rawStatuses = map[string]map[string]json.RawMessage{}
+	}
+	r.rawStatuses[id] = response.Body
+
+	return nil
+}
+
+// DecodeStatus decodes the raw fields of a status response, skipping the fields whose type does not match
+// switchbot.DeviceStatus instead of failing.
+func DecodeStatus(raw map[string]json.RawMessage) (switchbot.DeviceStatus, error) {
+	var status switchbot.DeviceStatus
+
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return status, err
+	}
+
+	// encoding/json keeps decoding past a type mismatch, leaving that field zero and reporting it at the end
+	var typeErr *json.UnmarshalTypeError
+	if err := json.Unmarshal(b, &status); err != nil && !errors.As(err, &typeErr) {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// RawStatus returns the raw fields of the latest status response of the device, or nil if none was recorded.
+func (r *ResponseRecorder) RawStatus(id string) map[string]json.RawMessage {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rawStatuses[id]
+}
+
+// Calls returns the number of api calls made through the recorder.
+func (r *ResponseRecorder) Calls() int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls
+}
+
+// QuotaRemaining returns the number of api calls left for the day from the latest response reporting it.
+// It reports false when no response had the header.
+func (r *ResponseRecorder) QuotaRemaining() (int, bool) {
+	if r == nil {
+		return 0, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.quota, r.quotaSeen
+}
+
+// ClockSkew returns how far the host clock is ahead of the switchbot api server, based on the latest Date header.
+// It returns 0 when no Date header has been seen.
+func (r *ResponseRecorder) ClockSkew() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.serverTime.IsZero() {
+		return 0
+	}
+
+	// the Date header has a resolution of one second
+	return r.localTime.Sub(r.serverTime).Truncate(time.Second)
+}
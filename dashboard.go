@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Dashboard is a dashboard definition accepted by the mackerel dashboards api (POST /api/v0/dashboards).
+type Dashboard struct {
+	Title   string            `json:"title"`
+	Memo    string            `json:"memo"`
+	URLPath string            `json:"urlPath"`
+	Widgets []DashboardWidget `json:"widgets"`
+}
+
+type DashboardWidget struct {
+	Type   string          `json:"type"`
+	Title  string          `json:"title"`
+	Graph  DashboardGraph  `json:"graph"`
+	Layout DashboardLayout `json:"layout"`
+}
+
+type DashboardGraph struct {
+	Type   string `json:"type"`
+	HostID string `json:"hostId"`
+	Name   string `json:"name"`
+}
+
+type DashboardLayout struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+const (
+	dashboardWidgetWidth  = 12
+	dashboardWidgetHeight = 6
+	dashboardColumns      = 2
+)
+
+// BuildDashboard returns a dashboard with a graph widget for each graph of the plugin posted by hostID.
+func (p SwitchBotPlugin) BuildDashboard(hostID string) Dashboard {
+	graphs := p.GraphDefinition()
+
+	keys := make([]string, 0, len(graphs))
+	for key := range graphs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	widgets := []DashboardWidget{}
+	for i, key := range keys {
+		widgets = append(widgets, DashboardWidget{
+			Type:  "graph",
+			Title: graphs[key].Label,
+			Graph: DashboardGraph{
+				Type:   "host",
+				HostID: hostID,
+				Name:   fmt.Sprintf("custom.%s", key),
+			},
+			Layout: DashboardLayout{
+				X:      (i % dashboardColumns) * dashboardWidgetWidth,
+				Y:      (i / dashboardColumns) * dashboardWidgetHeight,
+				Width:  dashboardWidgetWidth,
+				Height: dashboardWidgetHeight,
+			},
+		})
+	}
+
+	return Dashboard{
+		Title:   "SwitchBot",
+		Memo:    "generated by mackerel-plugin-switchbot",
+		URLPath: p.GetPrefix(),
+		Widgets: widgets,
+	}
+}
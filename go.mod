@@ -2,13 +2,15 @@ module github.com/natsuneko-laboratory/mackerel-plugin-switchbot
 
 go 1.23.6
 
-require github.com/mackerelio/go-mackerel-plugin v0.1.5
+require (
+	github.com/mackerelio/go-mackerel-plugin v0.1.5
+	github.com/nasa9084/go-switchbot/v4 v4.0.1
+)
 
 require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/mackerelio/golib v1.2.1 // indirect
 	github.com/mattn/go-sqlite3 v1.14.24 // indirect
 	github.com/nasa9084/go-switchbot v1.0.0 // indirect
-	github.com/nasa9084/go-switchbot/v4 v4.0.1 // indirect
 	golang.org/x/text v0.15.0 // indirect
 )
@@ -2,137 +2,1661 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
 	"github.com/nasa9084/go-switchbot/v4"
 )
 
+// debugLog writes verbose logs to stderr with -debug, keeping stdout for metrics.
+var debugLog = log.New(io.Discard, "[debug] ", log.LstdFlags)
+
+// version is set at build time with -ldflags "-X main.version=...", which goreleaser does by default.
+var version = "dev"
+
 // --------------------
 // instance methods
 // --------------------
 
-type SwitchBotPlugin struct {
-	Prefix          string
-	Targets         []string
-	SwitchBotClient *switchbot.Client
-	Statuses        map[string]*switchbot.DeviceStatus
+type SwitchBotPlugin struct {
+	Prefix          string
+	Targets         []string
+	GraphLayout     string
+	Concurrency     int
+	Timeout         time.Duration
+	DeviceTimeouts  map[string]time.Duration
+	Transforms      map[string]Transform
+	SkipZero        map[string]bool
+	Units           map[string]string
+	ValidRanges     map[string]ValidRange
+	TemperatureUnit string
+	MaxRetries      int
+	RetryBudget     *RetryBudget
+	Recorder        *ResponseRecorder
+	CallsToday      int
+	Latencies       map[string]time.Duration
+	DeviceNames     map[string]string
+	DeviceKeys      map[string]string
+	KeyTemplate     *template.Template
+	DeviceHubs      map[string]string
+	HubIDs          map[string]string
+	HubFailures     int
+	CountInfrared   bool
+	InfraredDevices []switchbot.InfraredDevice
+	SwitchBotClient SwitchBotClient
+	Statuses        map[string]*DeviceStatus
+}
+
+// FetchStatuses fetches the statuses of all targets, running up to Concurrency status calls at once.
+// Failures are returned joined in target order; the statuses of the other targets are kept.
+func (p SwitchBotPlugin) FetchStatuses(ctx context.Context) error {
+	type result struct {
+		status  *DeviceStatus
+		latency time.Duration
+		err     error
+	}
+
+	results := make([]result, len(p.Targets))
+	sem := make(chan struct{}, max(p.Concurrency, 1))
+	var wg sync.WaitGroup
+	health := &hubHealth{threshold: p.HubFailures, failures: map[string]int{}}
+
+	// a stable sort keeps the target order within a hub, and devices without a hub come first
+	order := make([]int, len(p.Targets))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return strings.Compare(p.HubIDs[p.Targets[a]], p.HubIDs[p.Targets[b]])
+	})
+
+	for _, i := range order {
+		target := p.Targets[i]
+		hub := p.HubIDs[target]
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if health.Down(hub) {
+				results[i] = result{err: fmt.Errorf("skipped status call of %s: the last %d status calls through hub %s failed", target, p.HubFailures, hub)}
+				return
+			}
+
+			start := time.Now()
+			status, err := p.FetchStatus(ctx, target)
+			health.Record(hub, err)
+			results[i] = result{status: status, latency: time.Since(start), err: err}
+		}()
+	}
+
+	wg.Wait()
+
+	// results are stored in target order so failures are reported in the same order regardless of timing
+	var errs []error
+	for i, target := range p.Targets {
+		result := results[i]
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+
+		debugLog.Printf("fetched status of %s (type %q) in %s", target, result.status.Type, result.latency)
+
+		p.Statuses[target] = result.status
+		p.Latencies[target] = result.latency
+	}
+
+	return errors.Join(errs...)
+}
+
+// hubHealth counts the status calls through each hub which failed in a row.
+// A zero threshold never reports a hub as down.
+type hubHealth struct {
+	mu        sync.Mutex
+	threshold int
+	failures  map[string]int
+}
+
+// Down reports whether threshold status calls through hub have failed in a row. Devices without a hub are never down.
+func (h *hubHealth) Down(hub string) bool {
+	if hub == "" || h.threshold <= 0 {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.failures[hub] >= h.threshold
+}
+
+// Record counts a status call through hub which failed with err, or resets the count if it succeeded.
+func (h *hubHealth) Record(hub string, err error) {
+	if hub == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.failures[hub]++
+	} else {
+		h.failures[hub] = 0
+	}
+}
+
+// FetchStatus fetches the status of target, retrying the status call with Retry.
+func (p SwitchBotPlugin) FetchStatus(ctx context.Context, target string) (*DeviceStatus, error) {
+	var status *DeviceStatus
+	err := p.Retry(ctx, func(ctx context.Context) (call *CallInfo, err error) {
+		status, call, err = p.fetchStatusOnce(ctx, target)
+		return call, err
+	})
+
+	return status, err
+}
+
+// Retry runs an api call, retrying it with backoff up to MaxRetries times unless it timed out.
+func (p SwitchBotPlugin) Retry(ctx context.Context, call func(ctx context.Context) (*CallInfo, error)) error {
+	for attempt := 0; ; attempt++ {
+		info, err := call(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || !info.Retryable() || attempt >= p.MaxRetries || !p.RetryBudget.Take() {
+			return err
+		}
+
+		wait := min(info.RetryAfter, MaxRetryInterval)
+		if wait == 0 {
+			wait = Backoff(attempt)
+		}
+
+		log.Printf("retrying in %s: %s", wait, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (p SwitchBotPlugin) fetchStatusOnce(ctx context.Context, target string) (*DeviceStatus, *CallInfo, error) {
+	timeout := p.GetTimeout(target)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx, call := WithCallInfo(ctx)
+
+	status, err := p.SwitchBotClient.Status(ctx, target)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, call, fmt.Errorf("status call of %s timed out after %s: %w", target, timeout, err)
+	}
+	if err != nil {
+		return nil, call, fmt.Errorf("failed to fetch status of %s: %w", target, err)
+	}
+
+	return &DeviceStatus{
+		DeviceStatus: &status,
+		Raw:          p.Recorder.RawStatus(target),
+	}, call, nil
+}
+
+// GetTimeout returns the per-device override for target if configured, otherwise the global timeout.
+func (p SwitchBotPlugin) GetTimeout(target string) time.Duration {
+	if timeout, ok := p.DeviceTimeouts[target]; ok {
+		return timeout
+	}
+
+	return p.Timeout
+}
+
+func (p SwitchBotPlugin) FetchMetrics() (map[string]float64, error) {
+	dict := map[string]float64{}
+
+	for _, target := range p.Targets {
+		for _, v := range p.DeviceMetrics(target) {
+			dict[p.MetricKey(target, v.Metric)] = v.Value
+		}
+	}
+
+	// metrics of non-wildcard graphs are keyed by their name alone, the graph key is prepended on output
+	maps.Copy(dict, p.MetaMetrics())
+
+	return dict, nil
+}
+
+// MetricValue is a value of a metric of a device.
+type MetricValue struct {
+	Metric *SwitchBotMetric
+	Value  float64
+}
+
+// DeviceMetrics returns the values of the metrics of target, with validity checks, conversions and transforms applied.
+// If the status of target could not be fetched, which FetchStatuses has already reported, it only reports Online as 0.
+func (p SwitchBotPlugin) DeviceMetrics(target string) []MetricValue {
+	status, ok := p.Statuses[target]
+	if !ok {
+		return []MetricValue{{Metric: Online, Value: 0}}
+	}
+
+	values := []MetricValue{}
+
+	for _, support := range SupportedMetrics[status.Type] {
+		if support.AvailableFunc != nil && !support.AvailableFunc(status) {
+			debugLog.Printf("skipped %s of %s: not reported", support.Name, target)
+			continue
+		}
+
+		value := support.ValueFunc(status)
+		if value == 0 && p.IsSkipZero(target, support) {
+			debugLog.Printf("skipped %s of %s: zero", support.Name, target)
+			continue
+		}
+
+		if r, ok := p.ValidRanges[support.Name]; ok {
+			invalid := !r.Contains(value)
+			values = append(values, MetricValue{Metric: InvalidMetric(support), Value: BoolToFloat(invalid)})
+			if invalid {
+				debugLog.Printf("skipped %s of %s: %v is out of range [%v, %v]", support.Name, target, value, r.Min, r.Max)
+				continue
+			}
+		}
+
+		// valid ranges are in Celsius, so temperatures are converted after checking them
+		if slices.Contains(TemperatureMetrics, support) && p.TemperatureUnit == TemperatureFahrenheit {
+			value = CelsiusToFahrenheit(value)
+		}
+
+		if transform, ok := p.GetTransform(target, support); ok {
+			value = transform.Apply(value, support.Unit)
+		}
+
+		values = append(values, MetricValue{Metric: support, Value: value})
+	}
+
+	if latency, ok := p.Latencies[target]; ok {
+		values = append(values, MetricValue{Metric: PollLatency, Value: float64(latency.Milliseconds())})
+	}
+
+	return values
+}
+
+// MetaMetrics returns the metrics about the plugin itself, keyed by their name in the meta graph.
+func (p SwitchBotPlugin) MetaMetrics() map[string]float64 {
+	fetched := 0
+	for _, target := range p.Targets {
+		if _, ok := p.Statuses[target]; ok {
+			fetched++
+		}
+	}
+
+	metrics := map[string]float64{
+		"clock_skew_seconds": p.Recorder.ClockSkew().Seconds(),
+		// devices whose status call failed even after retries
+		"api_errors":      float64(len(p.Targets) - fetched),
+		"devices_fetched": float64(fetched),
+		"api_calls":       float64(p.Recorder.Calls()),
+	}
+	if remaining, ok := p.Recorder.QuotaRemaining(); ok {
+		metrics["quota_remaining"] = float64(remaining)
+	}
+	// CallsToday stays zero when the state file could not be kept
+	if p.CallsToday > 0 {
+		metrics["api_calls_today"] = float64(p.CallsToday)
+	}
+	if p.CountInfrared {
+		metrics["infrared_device_count"] = float64(len(p.InfraredDevices))
+	}
+
+	return metrics
+}
+
+// GetTransform returns the transform for the metric of target, preferring a per-device one ("<device>.<metric>").
+func (p SwitchBotPlugin) GetTransform(target string, support *SwitchBotMetric) (Transform, bool) {
+	if transform, ok := p.Transforms[fmt.Sprintf("%s.%s", target, support.Name)]; ok {
+		return transform, true
+	}
+
+	transform, ok := p.Transforms[support.Name]
+	return transform, ok
+}
+
+// IsSkipZero reports whether a zero value of the metric of target should be omitted instead of emitted.
+func (p SwitchBotPlugin) IsSkipZero(target string, support *SwitchBotMetric) bool {
+	return p.SkipZero[fmt.Sprintf("%s.%s", target, support.Name)] || p.SkipZero[support.Name]
+}
+
+// GetUnit returns the unit of the metric, honoring user overrides.
+func (p SwitchBotPlugin) GetUnit(support *SwitchBotMetric) string {
+	if unit, ok := p.Units[support.Name]; ok {
+		return unit
+	}
+
+	return support.Unit
+}
+
+func (p SwitchBotPlugin) GetPrefix() string {
+	if p.Prefix == "" {
+		return "switchbot"
+	}
+
+	return p.Prefix
+}
+
+// GraphMetrics returns the metrics graphed for target, which are its supported metrics plus per-device plugin metrics.
+// A target whose status could not be fetched only has Online, which stays graphed while it reports 0.
+func (p SwitchBotPlugin) GraphMetrics(target string) []*SwitchBotMetric {
+	status, ok := p.Statuses[target]
+	if !ok {
+		return []*SwitchBotMetric{Online}
+	}
+
+	metrics := []*SwitchBotMetric{}
+
+	for _, support := range SupportedMetrics[status.Type] {
+		metrics = append(metrics, support)
+		if _, ok := p.ValidRanges[support.Name]; ok {
+			metrics = append(metrics, InvalidMetric(support))
+		}
+	}
+
+	return append(metrics, PollLatency)
+}
+
+// MetricKey returns the key of the metric for target in FetchMetrics, following the graph layout.
+func (p SwitchBotPlugin) MetricKey(target string, support *SwitchBotMetric) string {
+	switch p.GraphLayout {
+	case GraphLayoutGrouped:
+		return fmt.Sprintf("%s.%s.%s", p.GetPrefix(), support.Name, p.DeviceKey(target))
+	case GraphLayoutUnit:
+		return fmt.Sprintf("%s.%s.%s.%s", p.GetPrefix(), SanitizeMetricName(p.GetUnit(support)), support.Name, p.DeviceKey(target))
+	case GraphLayoutDevice:
+		return fmt.Sprintf("%s.%s.%s", p.GetPrefix(), p.DeviceKey(target), support.Name)
+	default:
+		if p.KeyTemplate != nil {
+			return p.RenderKey(target, support)
+		}
+
+		return fmt.Sprintf("%s.%s", p.DeviceKey(target), support.Name)
+	}
+}
+
+// KeyFields are the fields available to -key-template.
+type KeyFields struct {
+	Prefix     string
+	DeviceID   string
+	DeviceName string
+	Hub        string
+	Metric     string
+}
+
+// RenderKey returns the key of the metric for target rendered by KeyTemplate, falling back to the default key.
+func (p SwitchBotPlugin) RenderKey(target string, support *SwitchBotMetric) string {
+	fields := KeyFields{
+		Prefix:     p.GetPrefix(),
+		DeviceID:   target,
+		DeviceName: p.DeviceKey(target),
+		Hub:        p.DeviceHub(target),
+		Metric:     support.Name,
+	}
+
+	var b strings.Builder
+	if err := p.KeyTemplate.Execute(&b, fields); err == nil {
+		if key, ok := strings.CutPrefix(b.String(), fields.Prefix+"."); ok {
+			return key
+		}
+	}
+
+	log.Printf("failed to render the key of %s of %s, falling back to the default", support.Name, target)
+	return fmt.Sprintf("%s.%s", p.DeviceKey(target), support.Name)
+}
+
+// DeviceKey returns the segment identifying target in metric keys, which is its sanitized name with -label-by-name
+// and its id otherwise.
+func (p SwitchBotPlugin) DeviceKey(target string) string {
+	if key, ok := p.DeviceKeys[target]; ok {
+		return key
+	}
+
+	return target
+}
+
+// DeviceHub returns the key segment of the hub of target resolved by ResolveDeviceHubs, or NoHub if it is unknown.
+func (p SwitchBotPlugin) DeviceHub(target string) string {
+	if hub, ok := p.DeviceHubs[target]; ok {
+		return hub
+	}
+
+	return NoHub
+}
+
+// DeviceLabel returns the human readable name of target, falling back to its id.
+func (p SwitchBotPlugin) DeviceLabel(target string) string {
+	if name := p.DeviceNames[target]; name != "" {
+		return name
+	}
+
+	return target
+}
+
+func (p SwitchBotPlugin) GraphDefinition() map[string]mp.Graphs {
+	var graphs map[string]mp.Graphs
+	switch p.GraphLayout {
+	case GraphLayoutGrouped:
+		graphs = p.GroupedGraphDefinition()
+	case GraphLayoutUnit:
+		graphs = p.UnitGraphDefinition()
+	case GraphLayoutDevice:
+		graphs = p.DeviceGraphDefinition()
+	default:
+		graphs = p.FlatGraphDefinition()
+	}
+
+	for key, graph := range p.MetaGraphDefinition() {
+		graphs[key] = graph
+	}
+
+	return graphs
+}
+
+// MetaGraphDefinition returns graphs about the plugin itself, which do not belong to any device.
+func (p SwitchBotPlugin) MetaGraphDefinition() map[string]mp.Graphs {
+	prefix := p.GetPrefix()
+	metrics := []mp.Metrics{
+		{Name: "clock_skew_seconds", Label: "Clock Skew (seconds)"},
+		{Name: "api_errors", Label: "API Errors"},
+		{Name: "devices_fetched", Label: "Devices Fetched"},
+		{Name: "api_calls", Label: "API Calls"},
+		{Name: "quota_remaining", Label: "Quota Remaining"},
+		{Name: "api_calls_today", Label: "API Calls Today (UTC)"},
+	}
+	if p.CountInfrared {
+		metrics = append(metrics, mp.Metrics{Name: "infrared_device_count", Label: "Infrared Devices"})
+	}
+
+	return map[string]mp.Graphs{
+		fmt.Sprintf("%s.meta", prefix): {
+			Label:   "SwitchBot Plugin",
+			Unit:    mp.UnitFloat,
+			Metrics: metrics,
+		},
+	}
+}
+
+func (p SwitchBotPlugin) FlatGraphDefinition() map[string]mp.Graphs {
+	prefix := p.GetPrefix()
+	items := []mp.Metrics{}
+
+	for _, target := range p.Targets {
+		metrics := []mp.Metrics{}
+		supports := p.GraphMetrics(target)
+
+		for _, support := range supports {
+			label := support.Name
+			if _, ok := p.DeviceNames[target]; ok {
+				label = fmt.Sprintf("%s %s", p.DeviceLabel(target), support.Name)
+			}
+
+			metrics = append(metrics, mp.Metrics{
+				Name:  p.MetricKey(target, support),
+				Label: label,
+				Diff:  support.Diff,
+			})
+		}
+
+		items = append(items, metrics...)
+	}
+
+	return map[string]mp.Graphs{
+		prefix: {
+			Label:   "SwitchBot Metrics",
+			Metrics: items,
+		},
+	}
+}
+
+func (p SwitchBotPlugin) GroupedGraphDefinition() map[string]mp.Graphs {
+	prefix := p.GetPrefix()
+	graphs := map[string]mp.Graphs{}
+
+	for _, target := range p.Targets {
+		for _, support := range p.GraphMetrics(target) {
+			key := fmt.Sprintf("%s.%s", prefix, support.Name)
+			if _, ok := graphs[key]; !ok {
+				// one line per device, labeled by its key segment
+				graphs[key] = mp.Graphs{
+					Label: support.Label,
+					Unit:  p.GetUnit(support),
+					Metrics: []mp.Metrics{
+						{Name: "*", Label: "%1", Diff: support.Diff},
+					},
+				}
+			}
+		}
+	}
+
+	return graphs
+}
+
+func (p SwitchBotPlugin) UnitGraphDefinition() map[string]mp.Graphs {
+	prefix := p.GetPrefix()
+	graphs := map[string]mp.Graphs{}
+
+	for _, target := range p.Targets {
+		for _, support := range p.GraphMetrics(target) {
+			unit := p.GetUnit(support)
+			key := fmt.Sprintf("%s.%s", prefix, SanitizeMetricName(unit))
+			graph, ok := graphs[key]
+			if !ok {
+				graph = mp.Graphs{
+					Label:   fmt.Sprintf("SwitchBot Metrics (%s)", unit),
+					Unit:    unit,
+					Metrics: []mp.Metrics{},
+				}
+			}
+
+			// one line per device and metric; the metric segment comes first so that a wildcard
+			// does not match metrics sharing its name as a prefix (e.g. co2 and co2_invalid)
+			name := fmt.Sprintf("%s.*", support.Name)
+			if !slices.ContainsFunc(graph.Metrics, func(m mp.Metrics) bool { return m.Name == name }) {
+				graph.Metrics = append(graph.Metrics, mp.Metrics{
+					Name:  name,
+					Label: "%1 " + support.Name,
+					Diff:  support.Diff,
+				})
+			}
+			graphs[key] = graph
+		}
+	}
+
+	return graphs
+}
+
+// DeviceGraphDefinition returns a single wildcard graph, which mackerel splits into one graph per device.
+// Devices mix units, so values are graphed as plain floats.
+func (p SwitchBotPlugin) DeviceGraphDefinition() map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		fmt.Sprintf("%s.#", p.GetPrefix()): {
+			Label: "SwitchBot Device",
+			Unit:  mp.UnitFloat,
+			Metrics: []mp.Metrics{
+				// a single "*" matches every metric once; listing metric names would also match
+				// longer names sharing them as a prefix (e.g. co2 and co2_invalid)
+				{Name: "*", Label: "%1"},
+			},
+		},
+	}
+}
+
+// --------------------
+// initialize methods
+// --------------------
+func main() {
+	prefix := flag.String("prefix", "switchbot", "prefix for metrics")
+	devices := flag.String("devices", "", "comma separated list of devices to fetch values (\"-\" to read from stdin)")
+	devicesFile := flag.String("devices-file", "", "file listing devices to fetch values, one per line (\"#\" starts a comment), merged with -devices")
+	exclude := flag.String("exclude", "", "comma separated list of devices to skip")
+	deviceTypes := flag.String("device-types", "", "comma separated list of device types to limit devices to, case-insensitive")
+	hubs := flag.String("hubs", "", "comma separated list of hub ids to limit devices to those connected through them")
+	accessToken := flag.String("token", "", "access token for switchbot api, comma separated for multiple accounts (default: $SWITCHBOT_TOKEN)")
+	secretToken := flag.String("secret", "", "secret token for switchbot api, comma separated in the order of -token (default: $SWITCHBOT_SECRET)")
+	duplicates := flag.String("duplicate-devices", DuplicatesWarn, "handling of a device listed by several accounts: first or warn")
+	tempfile := flag.String("tempfile", "", "tempfile")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for each switchbot api call (0 to disable)")
+	transforms := flag.String("transforms", "", "comma separated list of linear calibrations as METRIC=SCALE:OFFSET or DEVICE_ID.METRIC=SCALE:OFFSET")
+	skipZero := flag.String("skip-zero", "", "comma separated list of METRIC or DEVICE_ID.METRIC to omit when the value is zero")
+	closedThreshold := flag.Int("closed-threshold", ClosedThreshold, "distance in percent from fully closed within which curtains and blinds are closed")
+	batterySentinels := flag.String("battery-sentinels", "-1,255", "comma separated list of battery values meaning unknown")
+	validRanges := flag.String("valid-ranges", "", "comma separated list of METRIC=MIN:MAX valid ranges, temperature in Celsius")
+	units := flag.String("units", "", "comma separated list of METRIC=UNIT overrides for graph units (grouped and unit layouts)")
+	labelByName := flag.Bool("label-by-name", false, "use device names instead of ids in metric keys and labels")
+	concurrency := flag.Int("concurrency", 4, "number of status calls to run at once")
+	maxRetries := flag.Int("max-retries", 2, "number of retries of a rate limited or failed status call")
+	maxRetriesTotal := flag.Int("max-retries-total", 0, "number of retries shared across all devices in a run (0 for no limit)")
+	serviceName := flag.String("service", "", "mackerel service name to also post metrics to as service metrics")
+	serviceMetrics := flag.String("service-metrics", "", "comma separated list of metric names to post as service metrics (default: all)")
+	apiKey := flag.String("apikey", "", "mackerel api key for posting service metrics (default: $MACKEREL_APIKEY)")
+	batchOutput := flag.Bool("batch-output", false, "collect all metric lines and write them to stdout at once")
+	printDashboard := flag.String("print-dashboard", "", "print a mackerel dashboard definition for the graphs posted by the given host id and exit")
+	graphLayout := flag.String("graph-layout", GraphLayoutFlat, "graph layout: flat, grouped (per metric), unit (per unit) or device (per device); changes metric keys")
+	listDevices := flag.Bool("list-devices", false, "print the id, type and name of the devices of the account and exit")
+	listJSON := flag.Bool("json", false, "print -list-devices as json")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	differentialElectricity := flag.Bool("differential-electricity", false, "also emit electricity_of_day_rate, the per-minute increase of electricity_of_day")
+	temperatureUnit := flag.String("temperature-unit", TemperatureCelsius, "unit of the temperature and comfort_index metrics: celsius or fahrenheit")
+	infraredCount := flag.Bool("infrared-count", false, "emit meta.infrared_device_count, the number of infrared remotes")
+	format := flag.String("format", FormatMackerel, "output format: mackerel or prometheus")
+	dumpJSON := flag.Bool("dump-json", false, "print the collected metrics and device types as json and exit, for debugging")
+	debug := flag.Bool("debug", false, "log fetched devices, unsupported types, skipped metrics and api latencies to stderr")
+	check := flag.Bool("check", false, "check the credentials and devices with one device list call, print OK or FAIL per device and exit")
+	keyTemplate := flag.String("key-template", "", "text/template of flat layout metric names, from .Prefix, .DeviceID, .DeviceName, .Hub and .Metric")
+	proxy := flag.String("proxy", "", "proxy url for switchbot api calls (default: $HTTPS_PROXY)")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "skip verifying the certificate of the switchbot api (insecure)")
+	groupByHub := flag.Bool("group-by-hub", false, "prefix device segments of metric names with the name of their hub")
+	hubFailures := flag.Int("hub-failures", 0, "skip the other devices of a hub after this many failed status calls through it in a row (0 to disable)")
+	strict := flag.Bool("strict", false, "exit without output if the status of any device cannot be fetched")
+	deviceTimeouts := flag.String("device-timeouts", "", "comma separated list of DEVICE_ID=TIMEOUT or DEVICE_TYPE=TIMEOUT overrides of -timeout")
+
+	flag.Parse()
+
+	if *debug {
+		debugLog.SetOutput(os.Stderr)
+	}
+
+	if *showVersion {
+		fmt.Printf("mackerel-plugin-switchbot %s (%s)\n", version, runtime.Version())
+		return
+	}
+
+	if *accessToken == "" {
+		*accessToken = os.Getenv("SWITCHBOT_TOKEN")
+	}
+	if *secretToken == "" {
+		*secretToken = os.Getenv("SWITCHBOT_SECRET")
+	}
+
+	if !slices.Contains([]string{GraphLayoutFlat, GraphLayoutGrouped, GraphLayoutUnit, GraphLayoutDevice}, *graphLayout) {
+		log.Fatalf("unknown graph layout: %s", *graphLayout)
+	}
+
+	if !slices.Contains([]string{FormatMackerel, FormatPrometheus}, *format) {
+		log.Fatalf("unknown format: %s", *format)
+	}
+
+	if !slices.Contains([]string{DuplicatesFirst, DuplicatesWarn}, *duplicates) {
+		log.Fatalf("unknown duplicate devices handling: %s", *duplicates)
+	}
+
+	if !slices.Contains([]string{TemperatureCelsius, TemperatureFahrenheit}, *temperatureUnit) {
+		log.Fatalf("unknown temperature unit: %s", *temperatureUnit)
+	}
+
+	if *groupByHub && *keyTemplate == "" {
+		*keyTemplate = GroupByHubKeyTemplate
+	}
+
+	var keyTmpl *template.Template
+	if *keyTemplate != "" {
+		// other layouts rely on the shape of their keys to match wildcard graphs
+		if *graphLayout != GraphLayoutFlat {
+			log.Fatalln("-key-template and -group-by-hub are only supported with the flat graph layout")
+		}
+
+		t, err := ParseKeyTemplate(*keyTemplate, *prefix)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		keyTmpl = t
+	}
+
+	if *differentialElectricity {
+		// the device layout graphs every metric through a single wildcard, which cannot mark some of them as Diff
+		if *graphLayout == GraphLayoutDevice {
+			log.Fatalln("-differential-electricity is not supported with the device graph layout")
+		}
+
+		EnableDifferentialElectricity()
+	}
+
+	timeouts, err := ParseDeviceTimeouts(*deviceTimeouts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *closedThreshold < 0 || *closedThreshold > 100 {
+		log.Fatalf("closed threshold must be between 0 and 100: %d", *closedThreshold)
+	}
+	ClosedThreshold = *closedThreshold
+
+	BatterySentinels, err = ParseInts(*batterySentinels)
+	if err != nil {
+		log.Fatalf("invalid battery sentinels: %s", err)
+	}
+
+	if *apiKey == "" {
+		*apiKey = os.Getenv("MACKEREL_APIKEY")
+	}
+	if *serviceName != "" && *apiKey == "" {
+		log.Fatalln("-apikey or $MACKEREL_APIKEY is required to post service metrics")
+	}
+
+	transformsMap, err := ParseTransforms(*transforms)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	skipZeroMap, err := ParseMetricSelectors(*skipZero)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	unitsMap, err := ParseUnits(*units)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(unitsMap) > 0 && !slices.Contains([]string{GraphLayoutGrouped, GraphLayoutUnit}, *graphLayout) {
+		log.Fatalln("-units is only supported with the grouped and unit graph layouts")
+	}
+
+	validRangesMap, err := ParseValidRanges(*validRanges)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	transport, err := NewTransport(*proxy, *insecureSkipVerify)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	recorder := &ResponseRecorder{Transport: transport}
+	tokens := strings.Split(*accessToken, ",")
+	secrets := strings.Split(*secretToken, ",")
+	if len(tokens) != len(secrets) {
+		log.Fatalf("-token lists %d accounts but -secret lists %d", len(tokens), len(secrets))
+	}
+
+	var c SwitchBotClient
+	if len(tokens) == 1 {
+		c = NewSwitchBotClient(switchbot.New(*accessToken, *secretToken, switchbot.WithHTTPClient(&http.Client{Transport: recorder})), recorder)
+	} else {
+		clients := []SwitchBotClient{}
+		for i := range tokens {
+			clients = append(clients, NewSwitchBotClient(switchbot.New(tokens[i], secrets[i], switchbot.WithHTTPClient(&http.Client{Transport: recorder})), recorder))
+		}
+		c = &MultiAccountClient{Clients: clients, Duplicates: *duplicates}
+	}
+
+	sb := SwitchBotPlugin{
+		Prefix:          *prefix,
+		SwitchBotClient: c,
+		Statuses:        map[string]*DeviceStatus{},
+		GraphLayout:     *graphLayout,
+		Concurrency:     *concurrency,
+		Timeout:         *timeout,
+		DeviceTimeouts:  timeouts,
+		Transforms:      transformsMap,
+		SkipZero:        skipZeroMap,
+		Units:           unitsMap,
+		ValidRanges:     validRangesMap,
+		TemperatureUnit: *temperatureUnit,
+		KeyTemplate:     keyTmpl,
+		MaxRetries:      *maxRetries,
+		RetryBudget:     NewRetryBudget(*maxRetriesTotal),
+		Recorder:        recorder,
+		Latencies:       map[string]time.Duration{},
+	}
+
+	if *listDevices {
+		list, _, err := sb.FetchDevices(context.Background())
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if *listJSON {
+			err = WriteDevicesJSON(os.Stdout, list)
+		} else {
+			err = WriteDevicesTable(os.Stdout, list)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if *devices == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		*devices = string(b)
+	}
+
+	if *devicesFile != "" {
+		b, err := os.ReadFile(*devicesFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		*devices = fmt.Sprintf("%s\n%s", *devices, StripComments(string(b)))
+	}
+
+	excluded := ParseDevices(*exclude)
+	devicesSlice := slices.DeleteFunc(ParseDevices(*devices), func(device string) bool {
+		return slices.Contains(excluded, device)
+	})
+
+	sb.Targets = devicesSlice
+
+	if *check {
+		list, infrared, err := sb.FetchDevices(context.Background())
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		LogUnsupportedDevices(log.Default(), devicesSlice, list)
+
+		if !CheckDevices(os.Stderr, devicesSlice, list, infrared) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// keys which are not target ids are device types, resolved to ids through the device list
+	typeTimeouts := slices.ContainsFunc(slices.Collect(maps.Keys(timeouts)), func(key string) bool {
+		return !slices.Contains(sb.Targets, key)
+	})
+
+	var list []switchbot.Device
+	if *labelByName || *deviceTypes != "" || *hubs != "" || *infraredCount || *groupByHub || typeTimeouts || *hubFailures > 0 || *printDashboard != "" || *debug {
+		var infrared []switchbot.InfraredDevice
+		list, infrared, err = sb.FetchDevices(context.Background())
+		if err != nil {
+			if *printDashboard != "" {
+				log.Fatalln(err)
+			}
+
+			// one failed list call should not drop every metric, so devices are reported by id and unfiltered instead
+			log.Printf("%s; reporting every device by id, without device names, hubs or infrared remotes", err)
+		} else {
+			debugLog.Printf("listed %d devices and %d infrared remotes", len(list), len(infrared))
+			LogUnsupportedDevices(debugLog, sb.Targets, list)
+
+			if *infraredCount {
+				sb.CountInfrared = true
+				sb.InfraredDevices = infrared
+			}
+
+			if *deviceTypes != "" {
+				sb.Targets = FilterDevicesByType(sb.Targets, list, strings.Split(*deviceTypes, ","))
+				debugLog.Printf("devices of types %s: %s", *deviceTypes, strings.Join(sb.Targets, ","))
+			}
+
+			if *hubs != "" {
+				sb.Targets = FilterDevicesByHub(sb.Targets, list, ParseDevices(*hubs))
+				debugLog.Printf("devices of hubs %s: %s", *hubs, strings.Join(sb.Targets, ","))
+			}
+
+			if *labelByName {
+				names := map[string]string{}
+				for _, device := range list {
+					names[device.ID] = device.Name
+				}
+
+				sb.DeviceNames = names
+				sb.DeviceKeys = ResolveDeviceKeys(sb.Targets, names)
+			}
+
+			if *groupByHub {
+				sb.DeviceHubs = ResolveDeviceHubs(list)
+			}
+
+			if typeTimeouts {
+				sb.DeviceTimeouts = ResolveDeviceTimeouts(timeouts, list)
+			}
+
+			if *hubFailures > 0 {
+				sb.HubFailures = *hubFailures
+				sb.HubIDs = ResolveHubIDs(list)
+			}
+		}
+	}
+
+	if *printDashboard != "" {
+		// the device list already tells the types, so no status call is made
+		sb.Statuses = DeviceTypeStatuses(sb.Targets, list)
+
+		b, err := json.MarshalIndent(sb.BuildDashboard(*printDashboard), "", "  ")
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		fmt.Println(string(b))
+		return
+	}
+
+	debugLog.Printf("fetching %d devices: %s", len(sb.Targets), strings.Join(sb.Targets, ","))
+
+	err = sb.FetchStatuses(context.Background())
+	if err != nil {
+		if *strict {
+			log.Fatalln(err)
+		}
+
+		// one flaky device should not drop the metrics of the others
+		log.Println(err)
+	}
+
+	sb.CallsToday, err = AddDailyCalls(DailyCallsPath(*tempfile, *accessToken), recorder.Calls(), time.Now())
+	if err != nil {
+		log.Printf("failed to count api calls of the day: %s", err)
+	}
+
+	if *dumpJSON {
+		if err := sb.WriteJSON(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if *format == FormatPrometheus {
+		if err := sb.WritePrometheus(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if err := sb.Output(*tempfile, *batchOutput); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *serviceName != "" && os.Getenv("MACKEREL_AGENT_PLUGIN_META") == "" {
+		poster := ServicePoster{
+			APIKey:      *apiKey,
+			ServiceName: *serviceName,
+			HTTPClient:  &http.Client{Timeout: *timeout},
+		}
+		if *serviceMetrics != "" {
+			poster.MetricNames = strings.Split(*serviceMetrics, ",")
+		}
+
+		// host metrics are already written to stdout, so a failure here is only logged
+		metrics, err := sb.FetchMetrics()
+		if err == nil {
+			err = poster.Post(sb.MetricNames(metrics), time.Now())
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+var invalidMetricNameRegexp = regexp.MustCompile(`[^-a-zA-Z0-9_]+`)
+
+// SanitizeMetricName turns name into a single metric key segment, replacing runs of characters
+// which mackerel does not allow (including dots and non-ASCII characters) with an underscore.
+func SanitizeMetricName(name string) string {
+	return strings.Trim(invalidMetricNameRegexp.ReplaceAllString(name, "_"), "_")
+}
+
+// ResolveDeviceKeys returns the key segment of each target based on its name.
+// Targets whose name is empty, sanitizes to nothing or collides with another target keep their id.
+func ResolveDeviceKeys(targets []string, names map[string]string) map[string]string {
+	counts := map[string]int{}
+	for _, target := range targets {
+		if key := SanitizeMetricName(names[target]); key != "" {
+			counts[key]++
+		}
+	}
+
+	keys := map[string]string{}
+	for _, target := range targets {
+		key := SanitizeMetricName(names[target])
+		if key == "" || counts[key] > 1 || (key != target && slices.Contains(targets, key)) {
+			continue
+		}
+
+		keys[target] = key
+	}
+
+	return keys
+}
+
+// GroupByHubKeyTemplate is the -key-template used by -group-by-hub.
+const GroupByHubKeyTemplate = "{{.Prefix}}.{{.Hub}}.{{.DeviceID}}.{{.Metric}}"
+
+// NoHub is the hub segment of devices which connect to the cloud by themselves, including hubs.
+const NoHub = "none"
+
+// ResolveDeviceHubs returns the key segment of the hub of each device, which is the sanitized name of the hub
+// ("hubDeviceId" of the device list), falling back to its id.
+func ResolveDeviceHubs(devices []switchbot.Device) map[string]string {
+	names := map[string]string{}
+	for _, device := range devices {
+		names[device.ID] = device.Name
+	}
+
+	hubs := map[string]string{}
+	for _, device := range devices {
+		if !HasHub(device) {
+			hubs[device.ID] = NoHub
+			continue
+		}
+
+		if name := SanitizeMetricName(names[device.Hub]); name != "" {
+			hubs[device.ID] = name
+		} else {
+			hubs[device.ID] = device.Hub
+		}
+	}
+
+	return hubs
+}
+
+// ResolveHubIDs returns the id of the hub of each device connecting through one ("hubDeviceId" of the device list).
+func ResolveHubIDs(devices []switchbot.Device) map[string]string {
+	hubs := map[string]string{}
+	for _, device := range devices {
+		if HasHub(device) {
+			hubs[device.ID] = device.Hub
+		}
+	}
+
+	return hubs
+}
+
+// HasHub reports whether device connects to the cloud through a hub.
+// Devices without a hub report an empty or all zero hubDeviceId, or their own id.
+func HasHub(device switchbot.Device) bool {
+	return strings.Trim(device.Hub, "0") != "" && device.Hub != device.ID
+}
+
+// ParseDevices parses a comma or newline separated list of device ids, dropping blanks and duplicates.
+func ParseDevices(s string) []string {
+	devices := []string{}
+	seen := map[string]bool{}
+
+	for _, device := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		device = strings.TrimSpace(device)
+		if device == "" || seen[device] {
+			continue
+		}
+
+		seen[device] = true
+		devices = append(devices, device)
+	}
+
+	return devices
+}
+
+// StripComments removes everything from a "#" to the end of each line of s.
+func StripComments(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i], _, _ = strings.Cut(line, "#")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ParseInts parses a comma separated list of integers.
+func ParseInts(s string) ([]int, error) {
+	values := []int{}
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// FetchDevices returns the physical devices and the infrared remotes of the account.
+// Infrared remotes have no status, so only their existence can be recorded.
+func (p SwitchBotPlugin) FetchDevices(ctx context.Context) ([]switchbot.Device, []switchbot.InfraredDevice, error) {
+	var devices []switchbot.Device
+	var infrared []switchbot.InfraredDevice
+	err := p.Retry(ctx, func(ctx context.Context) (call *CallInfo, err error) {
+		if p.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+			defer cancel()
+		}
+
+		ctx, call = WithCallInfo(ctx)
+		devices, infrared, err = p.SwitchBotClient.List(ctx)
+		return call, err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	return devices, infrared, nil
+}
+
+// CheckDevices writes OK or FAIL for each target to w, depending on whether it is a physical device of the account.
+// It reports whether every target is OK.
+func CheckDevices(w io.Writer, targets []string, devices []switchbot.Device, infrared []switchbot.InfraredDevice) bool {
+	ok := true
+
+	for _, target := range targets {
+		switch {
+		case slices.ContainsFunc(devices, func(d switchbot.Device) bool { return d.ID == target }):
+			fmt.Fprintf(w, "OK\t%s\n", target)
+		case slices.ContainsFunc(infrared, func(d switchbot.InfraredDevice) bool { return d.ID == target }):
+			fmt.Fprintf(w, "FAIL\t%s\tinfrared remotes have no status\n", target)
+			ok = false
+		default:
+			fmt.Fprintf(w, "FAIL\t%s\tnot found in the account\n", target)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// LogUnsupportedDevices logs the targets whose type in devices has no SupportedMetrics, so emit no metrics.
+func LogUnsupportedDevices(l *log.Logger, targets []string, devices []switchbot.Device) {
+	for _, device := range devices {
+		if _, ok := SupportedMetrics[device.Type]; !ok && slices.Contains(targets, device.ID) {
+			l.Printf("device %s is of type %q, which is not in SupportedMetrics; no metrics are emitted for it", device.ID, device.Type)
+		}
+	}
+}
+
+// FilterDevicesByType returns the targets whose type in devices matches one of types, ignoring case.
+func FilterDevicesByType(targets []string, devices []switchbot.Device, types []string) []string {
+	deviceTypes := map[string]switchbot.PhysicalDeviceType{}
+	for _, device := range devices {
+		deviceTypes[device.ID] = device.Type
+	}
+
+	filtered := []string{}
+	for _, target := range targets {
+		deviceType, ok := deviceTypes[target]
+		if !ok {
+			continue
+		}
+
+		if slices.ContainsFunc(types, func(t string) bool { return strings.EqualFold(strings.TrimSpace(t), string(deviceType)) }) {
+			filtered = append(filtered, target)
+		}
+	}
+
+	return filtered
+}
+
+// FilterDevicesByHub returns the targets connected through one of hubs or being one of them.
+func FilterDevicesByHub(targets []string, devices []switchbot.Device, hubs []string) []string {
+	deviceHubs := map[string]string{}
+	for _, device := range devices {
+		deviceHubs[device.ID] = device.Hub
+	}
+
+	filtered := []string{}
+	for _, target := range targets {
+		hub, ok := deviceHubs[target]
+		if !ok {
+			continue
+		}
+
+		if slices.Contains(hubs, hub) || slices.Contains(hubs, target) {
+			filtered = append(filtered, target)
+		}
+	}
+
+	return filtered
+}
+
+// DeviceTypeStatuses returns statuses holding only the id and type of the targets listed in devices.
+func DeviceTypeStatuses(targets []string, devices []switchbot.Device) map[string]*DeviceStatus {
+	statuses := map[string]*DeviceStatus{}
+	for _, device := range devices {
+		if slices.Contains(targets, device.ID) {
+			statuses[device.ID] = &DeviceStatus{DeviceStatus: &switchbot.DeviceStatus{ID: device.ID, Type: device.Type}}
+		}
+	}
+
+	return statuses
+}
+
+// ParseKeyValues parses a comma separated list of KEY=VALUE pairs.
+func ParseKeyValues(s string) (map[string]string, error) {
+	dict := map[string]string{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid key-value pair %q", pair)
+		}
+
+		dict[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return dict, nil
+}
+
+func BoolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// CalculatePowerFactor returns real power divided by apparent power (voltage * current), clamped to [0, 1].
+// It reports false when any input is missing (zero), as the ratio is undefined then.
+func CalculatePowerFactor(power, voltage, current float64) (float64, bool) {
+	if power <= 0 || voltage <= 0 || current <= 0 {
+		return 0, false
+	}
+
+	return Clamp(power/(voltage*current), 0, 1), true
+}
+
+// CalculateFilterLife returns the remaining life of a filter in percent from its rated hours and the hours used,
+// clamped to [0, 100]. It reports false when the rated hours are missing (zero), as the ratio is undefined then.
+func CalculateFilterLife(effectiveUsageHours, usedHours float64) (float64, bool) {
+	if effectiveUsageHours <= 0 {
+		return 0, false
+	}
+
+	return Clamp((effectiveUsageHours-usedHours)/effectiveUsageHours*100, 0, 100), true
+}
+
+// CalculateHumidex returns the Humidex for temperature (degrees Celsius) and relative humidity (percent),
+// using the vapour pressure approximated by the Magnus formula.
+func CalculateHumidex(temperature, humidity float64) float64 {
+	vapourPressure := 6.112 * math.Pow(10, 7.5*temperature/(237.7+temperature)) * humidity / 100
+	return temperature + 5.0/9.0*(vapourPressure-10)
+}
+
+// NewColorChannelMetric returns a metric of one channel (0 red, 1 green, 2 blue) of "color".
+func NewColorChannelMetric(name, label string, channel int) *SwitchBotMetric {
+	return &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  name,
+			Label: label,
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return float64(ParseColor(status.Color)[channel])
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			return status.Color != ""
+		},
+	}
+}
+
+// ParseColor parses a "R:G:B" color with channels of 0 to 255.
+// A malformed color, or a channel out of range, is read as 0 rather than failing the run.
+func ParseColor(s string) [3]int {
+	var rgb [3]int
+
+	parts := strings.Split(s, ":")
+	if len(parts) != len(rgb) {
+		return rgb
+	}
+
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || value < 0 || value > 255 {
+			continue
+		}
+		rgb[i] = value
+	}
+
+	return rgb
+}
+
+// Clamp restricts value to the range [min, max].
+func Clamp(value, min, max float64) float64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// ParseDeviceTimeouts parses a comma separated list of DEVICE_ID=TIMEOUT or DEVICE_TYPE=TIMEOUT overrides.
+func ParseDeviceTimeouts(s string) (map[string]time.Duration, error) {
+	pairs, err := ParseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := map[string]time.Duration{}
+
+	for id, value := range pairs {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for device %s: %w", id, err)
+		}
+
+		timeouts[id] = timeout
+	}
+
+	return timeouts, nil
+}
+
+// ResolveDeviceTimeouts adds the timeouts keyed by device type (ignoring case) in timeouts to the devices of that type,
+// keyed by their id. Devices with a timeout of their own keep it.
+func ResolveDeviceTimeouts(timeouts map[string]time.Duration, devices []switchbot.Device) map[string]time.Duration {
+	resolved := maps.Clone(timeouts)
+
+	for _, device := range devices {
+		if _, ok := timeouts[device.ID]; ok {
+			continue
+		}
+
+		for key, timeout := range timeouts {
+			if strings.EqualFold(key, string(device.Type)) {
+				resolved[device.ID] = timeout
+			}
+		}
+	}
+
+	return resolved
+}
+
+// declares
+
+// RetryInterval is the base wait before retrying a failed api call, doubled on every attempt up to MaxRetryInterval.
+const (
+	RetryInterval    = time.Second
+	MaxRetryInterval = 30 * time.Second
+)
+
+// Backoff returns the wait before the retry following attempt (0-based), with jitter of up to half of the wait.
+func Backoff(attempt int) time.Duration {
+	wait := MaxRetryInterval
+	if attempt < 5 {
+		wait = min(RetryInterval<<attempt, MaxRetryInterval)
+	}
+
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// RetryBudget is the number of retries shared by every api call in a run. A nil RetryBudget is unlimited.
+type RetryBudget struct {
+	mu        sync.Mutex
+	remaining int
+}
+
+// NewRetryBudget returns a budget of retries, or nil (unlimited) if retries is not positive.
+func NewRetryBudget(retries int) *RetryBudget {
+	if retries <= 0 {
+		return nil
+	}
+
+	return &RetryBudget{remaining: retries}
+}
+
+// Take consumes one retry, reporting false when the budget is exhausted.
+func (b *RetryBudget) Take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.remaining <= 0 {
+		return false
+	}
+
+	b.remaining--
+	return true
+}
+
+// BatterySentinels are battery values reported by devices which do not know their battery level.
+var BatterySentinels = []int{-1, 255}
+
+// ClosedThreshold is the distance in percent from a fully closed position within which curtains and blinds count as closed.
+var ClosedThreshold = 5
+
+// ValidRange is the inclusive range of plausible values of a metric.
+// Values outside of it are omitted and flagged by the "<metric>_invalid" metric instead.
+type ValidRange struct {
+	Min float64
+	Max float64
+}
+
+func (r ValidRange) Contains(value float64) bool {
+	return r.Min <= value && value <= r.Max
+}
+
+// DefaultValidRanges are the built-in valid ranges in api units (temperature in Celsius), overridable with -valid-ranges.
+var DefaultValidRanges = map[string]ValidRange{
+	"temperature": {Min: -40, Max: 85},
+	"humidity":    {Min: 0, Max: 100},
+	"co2":         {Min: 0, Max: 10000},
+}
+
+// ParseValidRanges parses a comma separated list of METRIC=MIN:MAX and merges it into the default ranges.
+func ParseValidRanges(s string) (map[string]ValidRange, error) {
+	pairs, err := ParseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := maps.Clone(DefaultValidRanges)
+
+	for name, value := range pairs {
+		if FindMetric(name) == nil {
+			return nil, fmt.Errorf("unknown metric %s in valid range", name)
+		}
+
+		min, max, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid valid range %s=%s, expected MIN:MAX", name, value)
+		}
+
+		var r ValidRange
+		if r.Min, err = strconv.ParseFloat(min, 64); err != nil {
+			return nil, fmt.Errorf("invalid minimum in valid range of %s: %w", name, err)
+		}
+		if r.Max, err = strconv.ParseFloat(max, 64); err != nil {
+			return nil, fmt.Errorf("invalid maximum in valid range of %s: %w", name, err)
+		}
+		if r.Min > r.Max {
+			return nil, fmt.Errorf("minimum is greater than maximum in valid range of %s", name)
+		}
+
+		ranges[name] = r
+	}
+
+	return ranges, nil
 }
 
-func (p SwitchBotPlugin) FetchStatuses() error {
-	for _, target := range p.Targets {
-		status, err := p.SwitchBotClient.Device().Status(context.Background(), target)
-		if err != nil {
-			return err
-		}
+// Transform is a linear calibration (value*Scale+Offset) applied to a metric value.
+type Transform struct {
+	Scale  float64
+	Offset float64
+}
 
-		p.Statuses[target] = &status
+// Apply transforms value, rounding to the nearest integer for integer metrics.
+func (t Transform) Apply(value float64, unit string) float64 {
+	value = value*t.Scale + t.Offset
+	if unit == mp.UnitInteger {
+		return math.Round(value)
 	}
 
-	return nil
+	return value
 }
 
-func (p SwitchBotPlugin) FetchMetrics() (map[string]float64, error) {
-	dict := map[string]float64{}
+var metricKeyRegexp = regexp.MustCompile(`^[-a-zA-Z0-9_]+(\.[-a-zA-Z0-9_]+)*$`)
 
-	for _, target := range p.Targets {
-		status, ok := p.Statuses[target]
-		if !ok {
-			return nil, fmt.Errorf("no status for target %s", target)
-		}
+// ParseKeyTemplate parses a -key-template, checking that it renders a valid metric name under the prefix,
+// which is the graph key of the flat layout, and that the name differs between devices.
+func ParseKeyTemplate(s, prefix string) (*template.Template, error) {
+	t, err := template.New("key").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
 
-		supports := SupportedMetrics[status.Type]
+	keys := []string{}
+	for _, device := range []string{"DEVICE1", "DEVICE2"} {
+		var b strings.Builder
+		if err := t.Execute(&b, KeyFields{Prefix: prefix, DeviceID: device, DeviceName: "NAME_" + device, Hub: "HUB", Metric: "metric"}); err != nil {
+			return nil, fmt.Errorf("invalid key template: %w", err)
+		}
 
-		for _, support := range supports {
-			name := fmt.Sprintf("%s.%s", target, support.Name)
-			dict[name] = support.ValueFunc(status)
+		key, ok := strings.CutPrefix(b.String(), prefix+".")
+		if !ok || !metricKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid key template: %q must render \"%s.\" followed by dot separated segments of [-a-zA-Z0-9_]", s, prefix)
 		}
+		keys = append(keys, key)
 	}
 
-	return dict, nil
+	// otherwise every device would write to the same metric
+	if keys[0] == keys[1] {
+		return nil, fmt.Errorf("invalid key template: %q must use .DeviceID or .DeviceName", s)
+	}
+
+	return t, nil
 }
 
-func (p SwitchBotPlugin) GetPrefix() string {
-	if p.Prefix == "" {
-		return "switchbot"
+// ParseTransforms parses a list of METRIC=SCALE:OFFSET (or DEVICE_ID.METRIC=SCALE:OFFSET) definitions.
+func ParseTransforms(s string) (map[string]Transform, error) {
+	pairs, err := ParseKeyValues(s)
+	if err != nil {
+		return nil, err
 	}
 
-	return p.Prefix
-}
+	transforms := map[string]Transform{}
 
-func (p SwitchBotPlugin) GraphDefinition() map[string]mp.Graphs {
-	prefix := p.GetPrefix()
-	items := []mp.Metrics{}
+	for key, value := range pairs {
+		if err := ValidateMetricSelector(key); err != nil {
+			return nil, err
+		}
 
-	for _, target := range p.Targets {
-		status, ok := p.Statuses[target]
+		scale, offset, ok := strings.Cut(value, ":")
 		if !ok {
-			continue
+			return nil, fmt.Errorf("invalid transform %s=%s, expected SCALE:OFFSET", key, value)
 		}
 
-		metrics := []mp.Metrics{}
-		supports := SupportedMetrics[status.Type]
-
-		for _, support := range supports {
-			metrics = append(metrics, mp.Metrics{
-				Name:  fmt.Sprintf("%s.%s", target, support.Name),
-				Label: support.Name,
-			})
+		var transform Transform
+		if transform.Scale, err = strconv.ParseFloat(scale, 64); err != nil {
+			return nil, fmt.Errorf("invalid scale in transform %s: %w", key, err)
+		}
+		if transform.Offset, err = strconv.ParseFloat(offset, 64); err != nil {
+			return nil, fmt.Errorf("invalid offset in transform %s: %w", key, err)
 		}
 
-		items = append(items, metrics...)
+		transforms[key] = transform
 	}
 
-	return map[string]mp.Graphs{
-		prefix: {
-			Label:   "SwitchBot Metrics",
-			Metrics: items,
-		},
-	}
+	return transforms, nil
 }
 
-// --------------------
-// initialize methods
-// --------------------
-func main() {
-	prefix := flag.String("prefix", "switchbot", "prefix for metrics")
-	devices := flag.String("devices", "", "comma separated list of devices to fetch values")
-	accessToken := flag.String("token", "", "access token for switchbot api")
-	secretToken := flag.String("secret", "", "secret token for switchbot api")
-	tempfile := flag.String("tempfile", "", "tempfile")
+// Graph layouts. Switching between them changes every metric key.
+const (
+	// GraphLayoutFlat puts every metric into the single "<prefix>" graph as "<prefix>.<device>.<metric>" (default).
+	GraphLayoutFlat = "flat"
+	// GraphLayoutGrouped emits one graph per metric as "<prefix>.<metric>.<device>", carrying the metric's unit.
+	GraphLayoutGrouped = "grouped"
+	// GraphLayoutUnit emits one graph per unit as "<prefix>.<unit>.<metric>.<device>", carrying that unit.
+	GraphLayoutUnit = "unit"
+	// GraphLayoutDevice emits one graph per device as "<prefix>.<device>.<metric>" through the wildcard graph "<prefix>.#".
+	// Its metric names equal the flat layout's, so only graph definitions change when switching between the two.
+	GraphLayoutDevice = "device"
+)
 
-	flag.Parse()
+// Output formats.
+const (
+	// FormatMackerel runs the plugin for mackerel-agent (default).
+	FormatMackerel = "mackerel"
+	// FormatPrometheus prints the metrics in the prometheus text exposition format for scraping.
+	FormatPrometheus = "prometheus"
+)
+
+// Temperature units of TemperatureMetrics. The api reports Celsius.
+const (
+	TemperatureCelsius    = "celsius"
+	TemperatureFahrenheit = "fahrenheit"
+)
 
-	c := switchbot.New(*accessToken, *secretToken)
+// TemperatureMetrics are the metrics in degrees Celsius, which -temperature-unit converts.
+var TemperatureMetrics = []*SwitchBotMetric{Temperature, ComfortIndex}
 
-	devicesSlice := strings.Split(*devices, ",")
-	sb := SwitchBotPlugin{
-		Prefix:          *prefix,
-		SwitchBotClient: c,
-		Statuses:        map[string]*switchbot.DeviceStatus{},
-		Targets:         devicesSlice,
+// CelsiusToFahrenheit converts a temperature in degrees Celsius to degrees Fahrenheit.
+func CelsiusToFahrenheit(celsius float64) float64 {
+	return celsius*9/5 + 32
+}
+
+// DeviceStatus is a device status along with the raw fields of the api response,
+// for fields which go-switchbot does not decode.
+type DeviceStatus struct {
+	*switchbot.DeviceStatus
+	Raw map[string]json.RawMessage
+}
+
+// RawFloat returns the raw field key as a number, reporting false if it is missing or not a number.
+func (s *DeviceStatus) RawFloat(key string) (float64, bool) {
+	var value float64
+	if err := json.Unmarshal(s.Raw[key], &value); err != nil {
+		return 0, false
 	}
 
-	helper := mp.NewMackerelPlugin(sb)
-	helper.Tempfile = *tempfile
+	return value, true
+}
 
-	err := sb.FetchStatuses()
-	if err != nil {
-		log.Fatalln(err)
+// RawFilterLife returns the remaining life of the filter from the raw "filterElement" object of the Humidifier 2,
+// reporting false if it is missing or carries no rated hours.
+func (s *DeviceStatus) RawFilterLife() (float64, bool) {
+	var filter struct {
+		EffectiveUsageHours float64 `json:"effectiveUsageHours"`
+		UsedHours           float64 `json:"usedHours"`
+	}
+	if err := json.Unmarshal(s.Raw["filterElement"], &filter); err != nil {
+		return 0, false
 	}
 
-	helper.Run()
+	return CalculateFilterLife(filter.EffectiveUsageHours, filter.UsedHours)
 }
 
-// declares
+// RawString returns the raw field key as a string, reporting false if it is missing or not a string.
+func (s *DeviceStatus) RawString(key string) (string, bool) {
+	var value string
+	if err := json.Unmarshal(s.Raw[key], &value); err != nil {
+		return "", false
+	}
+
+	return value, true
+}
 
 type SwitchBotMetric struct {
 	*mp.Metrics
 	Unit      string
-	ValueFunc func(status *switchbot.DeviceStatus) float64
+	ValueFunc func(status *DeviceStatus) float64
+	// AvailableFunc reports whether status carries a value for the metric; the metric is omitted when it returns false.
+	// A nil AvailableFunc means the value is always available.
+	AvailableFunc func(status *DeviceStatus) bool
 }
 
 var (
@@ -142,9 +1666,12 @@ var (
 			Label: "SwitchBot (Battery)",
 		},
 		Unit: mp.UnitPercentage,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.Battery)
 		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			return !slices.Contains(BatterySentinels, status.Battery)
+		},
 	}
 
 	Temperature = &SwitchBotMetric{
@@ -152,7 +1679,7 @@ var (
 			Name:  "temperature",
 			Label: "SwitchBot (Temperature)"},
 		Unit: mp.UnitFloat,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return status.Temperature
 		},
 	}
@@ -163,7 +1690,7 @@ var (
 			Label: "SwitchBot (Humidity)",
 		},
 		Unit: mp.UnitPercentage,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.Humidity)
 		},
 	}
@@ -174,18 +1701,61 @@ var (
 			Label: "SwitchBot (CO2)",
 		},
 		Unit: mp.UnitInteger,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.CO2)
 		},
 	}
 
+	// HubCO2 is CO2 for the Hub 2, which only reports "CO2" on some SKUs and firmware.
+	// The field is checked for presence, as an absent one decodes to the same 0 as a genuine reading.
+	HubCO2 = &SwitchBotMetric{
+		Metrics:   CO2.Metrics,
+		Unit:      CO2.Unit,
+		ValueFunc: CO2.ValueFunc,
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := status.RawFloat("CO2")
+			return ok
+		},
+	}
+
+	// LeakStatus reads "status" of the Water Leak Detector, which is 1 when water is detected and 0 when dry.
+	LeakStatus = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "leak_status",
+			Label: "SwitchBot (Leak Status)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			value, _ := status.RawFloat("status")
+			return value
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := status.RawFloat("status")
+			return ok
+		},
+	}
+
 	ElectricityOfDay = &SwitchBotMetric{
 		Metrics: &mp.Metrics{
 			Name:  "electricity_of_day",
 			Label: "SwitchBot (Electricity of Day)",
 		},
 		Unit: mp.UnitInteger,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return float64(status.ElectricityOfDay)
+		},
+	}
+
+	// ElectricityOfDayRate is the per-minute increase of electricity_of_day, enabled by -differential-electricity.
+	// The counter resets at midnight; go-mackerel-plugin emits 0 instead of the negative difference then.
+	ElectricityOfDayRate = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "electricity_of_day_rate",
+			Label: "SwitchBot (Electricity of Day per Minute)",
+			Diff:  true,
+		},
+		Unit: mp.UnitFloat,
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.ElectricityOfDay)
 		},
 	}
@@ -196,30 +1766,101 @@ var (
 			Label: "SwitchBot (Electric Current)",
 		},
 		Unit: mp.UnitFloat,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.ElectricCurrent)
 		},
 	}
 
+	// Power is the instantaneous power in watts, reported as "weight" by the Plug Mini and "power" by the Relay Switch 1PM.
+	Power = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "power",
+			Label: "SwitchBot (Power)",
+		},
+		Unit: mp.UnitFloat,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			// "power" is the "ON"/"OFF" state on plugs, so it is only used when it is a number
+			if value, ok := status.RawFloat("power"); ok {
+				return value
+			}
+			return status.Weight
+		},
+	}
+
+	// SwitchStatus reads "switchStatus" of relay switches, which is 1 when on and 0 when off.
+	SwitchStatus = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "switch_status",
+			Label: "SwitchBot (Switch Status)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			value, _ := status.RawFloat("switchStatus")
+			return value
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := status.RawFloat("switchStatus")
+			return ok
+		},
+	}
+
+	// PowerFactor assumes the Plug Mini reports real power in watts as "weight",
+	// voltage in volts as "voltage" and current in amperes as "electricCurrent".
+	PowerFactor = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "power_factor",
+			Label: "SwitchBot (Power Factor)",
+		},
+		Unit: mp.UnitFloat,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			value, _ := CalculatePowerFactor(status.Weight, status.Voltage, status.ElectricCurrent)
+			return value
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := CalculatePowerFactor(status.Weight, status.Voltage, status.ElectricCurrent)
+			return ok
+		},
+	}
+
 	Brightness = &SwitchBotMetric{
 		Metrics: &mp.Metrics{
 			Name:  "brightness",
 			Label: "SwitchBot (Brightness)",
 		},
 		Unit: mp.UnitPercentage,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			value, _ := status.Brightness.Int()
 			return float64(value)
 		},
 	}
 
+	// PowerState is 1 when "power" is on and 0 otherwise, ignoring case.
+	// The Relay Switch 1PM reports watts as "power" instead, so it uses SwitchStatus.
+	PowerState = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "power_state",
+			Label: "SwitchBot (Power State)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return BoolToFloat(strings.EqualFold(string(status.Power), "on"))
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			return status.Power != ""
+		},
+	}
+
+	ColorRed   = NewColorChannelMetric("color_red", "SwitchBot (Color Red)", 0)
+	ColorGreen = NewColorChannelMetric("color_green", "SwitchBot (Color Green)", 1)
+	ColorBlue  = NewColorChannelMetric("color_blue", "SwitchBot (Color Blue)", 2)
+
 	ColorTemperature = &SwitchBotMetric{
 		Metrics: &mp.Metrics{
 			Name:  "color_temperature",
 			Label: "SwitchBot (Color Temperature)",
 		},
 		Unit: mp.UnitInteger,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.ColorTemperature)
 		},
 	}
@@ -230,91 +1871,428 @@ var (
 			Label: "SwitchBot (Nebulization Efficiency)",
 		},
 		Unit: mp.UnitPercentage,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.NebulizationEfficiency)
 		},
 	}
 
+	// FilterLife is the remaining life of the Humidifier 2 filter, from "filterElement" which go-switchbot does not decode.
+	FilterLife = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "filter_life",
+			Label: "SwitchBot (Filter Life)",
+		},
+		Unit: mp.UnitPercentage,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			value, _ := status.RawFilterLife()
+			return value
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := status.RawFilterLife()
+			return ok
+		},
+	}
+
 	FanSpeed = &SwitchBotMetric{
 		Metrics: &mp.Metrics{
 			Name:  "fan_speed",
 			Label: "SwitchBot (Fan Speed)",
 		},
 		Unit: mp.UnitPercentage,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
+			// circulator fans report "fanSpeed", which go-switchbot does not decode
+			if value, ok := status.RawFloat("fanSpeed"); ok {
+				return value
+			}
 			return float64(status.FanSpeed)
 		},
 	}
 
+	OscillationState = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "oscillation_state",
+			Label: "SwitchBot (Oscillation State)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			value, _ := status.RawString("oscillation")
+			return BoolToFloat(strings.EqualFold(value, "on"))
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := status.RawString("oscillation")
+			return ok
+		},
+	}
+
+	// SlidePosition is how far the device is closed: 0 is fully open and 100 fully closed.
+	// The Curtain family and the Roller Shade report it the same way, so it is not normalized.
 	SlidePosition = &SwitchBotMetric{
 		Metrics: &mp.Metrics{
 			Name:  "slide_position",
 			Label: "SwitchBot (Slide Position)",
 		},
 		Unit: mp.UnitPercentage,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.SlidePosition)
 		},
 	}
 
+	// ComfortIndex is the Humidex (Environment Canada), a "feels like" temperature in degrees Celsius
+	// (Fahrenheit with -temperature-unit=fahrenheit, like Temperature).
+	ComfortIndex = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "comfort_index",
+			Label: "SwitchBot (Comfort Index)",
+		},
+		Unit: mp.UnitFloat,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return CalculateHumidex(status.Temperature, float64(status.Humidity))
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			return status.Humidity > 0 && status.Humidity <= 100
+		},
+	}
+
+	// Online is 1 when the device is reachable. Robot vacuums report "onlineStatus";
+	// other devices count as online when their status could be fetched, as the api fails for unreachable ones,
+	// and DeviceMetrics reports 0 for devices whose status call failed.
+	Online = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "online",
+			Label: "SwitchBot (Online)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			if value, ok := status.RawString("onlineStatus"); ok {
+				return BoolToFloat(value == "online")
+			}
+			return 1
+		},
+	}
+
+	// LockState maps "lockState" to locked = 1, unlocked = 0 and jammed = 2.
+	LockState = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "lock_state",
+			Label: "SwitchBot (Lock State)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return LockStates[status.LockState]
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := LockStates[status.LockState]
+			return ok
+		},
+	}
+
+	// WorkingStatus maps "workingStatus" of robot vacuums through WorkingStatuses.
+	// Statuses missing from WorkingStatuses (e.g. added by newer firmware) are reported as UnknownWorkingStatus,
+	// so that a vacuum in an unexpected state is still visible.
+	WorkingStatus = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "working_status",
+			Label: "SwitchBot (Working Status)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			if value, ok := WorkingStatuses[status.WorkingStatus]; ok {
+				return value
+			}
+
+			return UnknownWorkingStatus
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			return status.WorkingStatus != ""
+		},
+	}
+
+	// ContactState maps "openState" to closed = 0, open = 1 and timeout (left open) = 2.
+	ContactState = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "contact_state",
+			Label: "SwitchBot (Contact State)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return ContactStates[status.OpenState]
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, ok := ContactStates[status.OpenState]
+			return ok
+		},
+	}
+
+	// AmbientBright is 1 when a contact or motion sensor reports its surroundings as "bright" and 0 when "dim".
+	// These sensors report brightness as a word rather than the numeric level read by Brightness and LightLevel.
+	AmbientBright = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "ambient_bright",
+			Label: "SwitchBot (Ambient Bright)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			value, _ := status.Brightness.AmbientBrightness()
+			return BoolToFloat(value == switchbot.AmbientBrightnessBright)
+		},
+		AvailableFunc: func(status *DeviceStatus) bool {
+			_, err := status.Brightness.AmbientBrightness()
+			return err == nil
+		},
+	}
+
+	// MotionDetected reflects "moveDetected" at the moment of polling only; motion between polls is not captured.
+	MotionDetected = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "motion_detected",
+			Label: "SwitchBot (Motion Detected)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return BoolToFloat(status.IsMoveDetected)
+		},
+	}
+
+	ChildLock = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "child_lock",
+			Label: "SwitchBot (Child Lock)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return BoolToFloat(status.IsChildLock)
+		},
+	}
+
+	// CurtainClosed treats slidePosition 100 as fully closed (0 is fully open).
+	CurtainClosed = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "closed",
+			Label: "SwitchBot (Closed)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return BoolToFloat(status.SlidePosition >= 100-ClosedThreshold)
+		},
+	}
+
+	// BlindTiltClosed treats slidePosition 0 (closed down) and 100 (closed up) as fully closed (50 is fully open).
+	BlindTiltClosed = &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  "closed",
+			Label: "SwitchBot (Closed)",
+		},
+		Unit: mp.UnitInteger,
+		ValueFunc: func(status *DeviceStatus) float64 {
+			return BoolToFloat(status.SlidePosition <= ClosedThreshold || status.SlidePosition >= 100-ClosedThreshold)
+		},
+	}
+
 	LightLevel = &SwitchBotMetric{
 		Metrics: &mp.Metrics{
 			Name:  "light_level",
 			Label: "SwitchBot (Light Level)",
 		},
 		Unit: mp.UnitInteger,
-		ValueFunc: func(status *switchbot.DeviceStatus) float64 {
+		ValueFunc: func(status *DeviceStatus) float64 {
 			return float64(status.LightLevel)
 		},
 	}
 )
 
+// InvalidMetric returns the 0/1 flag metric reporting that a value of support was outside its valid range.
+func InvalidMetric(support *SwitchBotMetric) *SwitchBotMetric {
+	return &SwitchBotMetric{
+		Metrics: &mp.Metrics{
+			Name:  fmt.Sprintf("%s_invalid", support.Name),
+			Label: strings.TrimSuffix(support.Label, ")") + " Invalid)",
+		},
+		Unit: mp.UnitInteger,
+	}
+}
+
+// LockStates maps the lock states reported by smart locks to metric values.
+var LockStates = map[string]float64{
+	"unlocked": 0,
+	"locked":   1,
+	"jammed":   2,
+}
+
+// UnknownWorkingStatus is the metric value of a working status missing from WorkingStatuses.
+const UnknownWorkingStatus = -1
+
+// WorkingStatuses maps the working statuses reported by robot vacuums to metric values.
+var WorkingStatuses = map[switchbot.CleanerWorkingStatus]float64{
+	switchbot.CleanerStandBy:          0,
+	switchbot.CleanerClearing:         1,
+	switchbot.CleanerPaused:           2,
+	switchbot.CleanerGotoChargeBase:   3,
+	switchbot.CleanerCharging:         4,
+	switchbot.CleanerChargeDone:       5,
+	switchbot.CleanerDormant:          6,
+	switchbot.CleanerInTrouble:        7,
+	switchbot.CleanerInRemoteControl:  8,
+	switchbot.CleanerInDustCollecting: 9,
+}
+
+// ContactStates maps the open states reported by contact sensors to metric values.
+var ContactStates = map[switchbot.OpenState]float64{
+	switchbot.ContactClose:           0,
+	switchbot.ContactOpen:            1,
+	switchbot.ContactTimeoutNotClose: 2,
+}
+
+// PollLatency is the duration of the status call of a device, including retries.
+// It is measured by the plugin, so it has no ValueFunc and is not part of SupportedMetrics.
+var PollLatency = &SwitchBotMetric{
+	Metrics: &mp.Metrics{
+		Name:  "poll_latency_ms",
+		Label: "SwitchBot (Poll Latency)",
+	},
+	Unit: mp.UnitMilliseconds,
+}
+
 // Unsupported List
-// Water Leak Detector
-// Mini Robot Vacuum K10+ Pro
-// K10+ Pro Combo
-// Floor Cleaning Robot S10
-// Evaporative Humidifier
-// Evaporative Humidifier (Auto-refill)
 // Air Purifier VOC
 // Air Purifier Table VOC
 // Air Purifier PM2.5
 // Air Purifier Table PM2.5
-// Roller Shade
-// Circulator Fan
-// Relay Switch 1PM
-// Relat Switch 1
 
 var SupportedMetrics = map[switchbot.PhysicalDeviceType][]*SwitchBotMetric{
-	switchbot.Bot:                      {Battery},
-	switchbot.Curtain:                  {Battery},
-	"Curtain3":                         {Battery},
-	switchbot.Hub:                      {},
-	switchbot.HubPlus:                  {},
-	switchbot.HubMini:                  {},
-	switchbot.Hub2:                     {Temperature, LightLevel, Humidity},
-	switchbot.Meter:                    {Temperature, Battery, Humidity},
-	switchbot.MeterPlus:                {Temperature, Battery, Humidity},
-	switchbot.MeterPro:                 {Temperature, Battery, Humidity},
-	switchbot.MeterProCO2:              {Temperature, Battery, Humidity, CO2},
-	switchbot.WoIOSensor:               {Temperature, Battery, Humidity},
-	switchbot.Lock:                     {Battery},
-	"Smart Lock Pro":                   {Battery},
-	switchbot.KeyPad:                   {},
-	switchbot.KeyPadTouch:              {},
-	switchbot.MotionSensor:             {Battery},
-	switchbot.ContactSensor:            {Battery},
-	switchbot.CeilingLight:             {Brightness, ColorTemperature},
-	switchbot.CeilingLightPro:          {Brightness, ColorTemperature},
-	switchbot.PlugMiniUS:               {ElectricityOfDay, ElectricCurrent},
-	switchbot.PlugMiniJP:               {ElectricityOfDay, ElectricCurrent},
-	switchbot.Plug:                     {},
-	switchbot.StripLight:               {Brightness},
-	switchbot.ColorBulb:                {Brightness, ColorTemperature},
-	switchbot.RobotVacuumCleanerS1:     {Battery},
-	switchbot.RobotVacuumCleanerS1Plus: {Battery},
-	"K10+":                             {Battery},
-	switchbot.Humidifier:               {Humidity, Temperature, NebulizationEfficiency},
-	switchbot.BlindTilt:                {SlidePosition},
-	"Battery Circulator Fan":           {Battery, FanSpeed},
+	switchbot.Bot:                         {Battery, PowerState},
+	switchbot.Curtain:                     {Battery, SlidePosition, CurtainClosed},
+	"Curtain3":                            {Battery, SlidePosition, CurtainClosed},
+	switchbot.Hub:                         {},
+	switchbot.HubPlus:                     {},
+	switchbot.HubMini:                     {},
+	switchbot.Hub2:                        {Temperature, LightLevel, Humidity, ComfortIndex, HubCO2},
+	switchbot.Meter:                       {Temperature, Battery, Humidity, ComfortIndex},
+	switchbot.MeterPlus:                   {Temperature, Battery, Humidity, ComfortIndex},
+	switchbot.MeterPro:                    {Temperature, Battery, Humidity, ComfortIndex},
+	switchbot.MeterProCO2:                 {Temperature, Battery, Humidity, ComfortIndex, CO2},
+	switchbot.WoIOSensor:                  {Temperature, Battery, Humidity, ComfortIndex},
+	switchbot.Lock:                        {Battery, LockState},
+	"Smart Lock Pro":                      {Battery, LockState},
+	switchbot.KeyPad:                      {},
+	switchbot.KeyPadTouch:                 {},
+	switchbot.MotionSensor:                {Battery, MotionDetected, AmbientBright},
+	switchbot.ContactSensor:               {Battery, ContactState, AmbientBright},
+	switchbot.CeilingLight:                {Brightness, ColorTemperature, PowerState},
+	switchbot.CeilingLightPro:             {Brightness, ColorTemperature, PowerState},
+	switchbot.PlugMiniUS:                  {ElectricityOfDay, ElectricCurrent, Power, PowerFactor, PowerState},
+	switchbot.PlugMiniJP:                  {ElectricityOfDay, ElectricCurrent, Power, PowerFactor, PowerState},
+	switchbot.Plug:                        {PowerState},
+	switchbot.StripLight:                  {Brightness, ColorRed, ColorGreen, ColorBlue, PowerState},
+	switchbot.ColorBulb:                   {Brightness, ColorTemperature, ColorRed, ColorGreen, ColorBlue, PowerState},
+	switchbot.RobotVacuumCleanerS1:        {Battery, WorkingStatus},
+	switchbot.RobotVacuumCleanerS1Plus:    {Battery, WorkingStatus},
+	"K10+":                                {Battery, WorkingStatus},
+	"K10+ Pro":                            {Battery, WorkingStatus},
+	"Robot Vacuum Cleaner K10+ Pro Combo": {Battery, WorkingStatus},
+	"Robot Vacuum Cleaner S10":            {Battery, WorkingStatus},
+	switchbot.Humidifier:                  {Humidity, ComfortIndex, Temperature, NebulizationEfficiency, ChildLock, PowerState},
+	switchbot.BlindTilt:                   {SlidePosition, BlindTiltClosed},
+	"Battery Circulator Fan":              {Battery, FanSpeed, PowerState},
+	"Circulator Fan":                      {FanSpeed, OscillationState, PowerState},
+	"Relay Switch 1PM":                    {SwitchStatus, Power},
+	"Relay Switch 1":                      {SwitchStatus},
+	"Water Detector":                      {Battery, LeakStatus},
+	"Humidifier2":                         {Humidity, ChildLock, PowerState, FilterLife},
+	"Roller Shade":                        {Battery, SlidePosition},
+}
+
+func init() {
+	// every device reports its reachability
+	for deviceType, supports := range SupportedMetrics {
+		SupportedMetrics[deviceType] = append(supports, Online)
+	}
+}
+
+// EnableDifferentialElectricity adds ElectricityOfDayRate to every device type reporting ElectricityOfDay.
+func EnableDifferentialElectricity() {
+	for deviceType, supports := range SupportedMetrics {
+		if slices.Contains(supports, ElectricityOfDay) {
+			SupportedMetrics[deviceType] = append(supports, ElectricityOfDayRate)
+		}
+	}
+}
+
+// Units lists the units accepted by mackerel.
+var Units = []string{
+	mp.UnitFloat,
+	mp.UnitInteger,
+	mp.UnitPercentage,
+	mp.UnitSeconds,
+	mp.UnitMilliseconds,
+	mp.UnitBytes,
+	mp.UnitBytesPerSecond,
+	mp.UnitBitsPerSecond,
+	mp.UnitIOPS,
+}
+
+// ParseUnits parses a comma separated list of METRIC=UNIT overrides.
+func ParseUnits(s string) (map[string]string, error) {
+	pairs, err := ParseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, unit := range pairs {
+		if FindMetric(name) == nil {
+			return nil, fmt.Errorf("unknown metric %s in unit override", name)
+		}
+
+		if !slices.Contains(Units, unit) {
+			return nil, fmt.Errorf("invalid unit %s for metric %s, must be one of %s", unit, name, strings.Join(Units, ", "))
+		}
+	}
+
+	return pairs, nil
+}
+
+// ParseMetricSelectors parses a comma separated list of METRIC or DEVICE_ID.METRIC selectors.
+func ParseMetricSelectors(s string) (map[string]bool, error) {
+	selectors := map[string]bool{}
+
+	for _, selector := range strings.Split(s, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+
+		if err := ValidateMetricSelector(selector); err != nil {
+			return nil, err
+		}
+
+		selectors[selector] = true
+	}
+
+	return selectors, nil
+}
+
+// ValidateMetricSelector checks that the metric part of a METRIC or DEVICE_ID.METRIC selector is known.
+func ValidateMetricSelector(selector string) error {
+	name := selector
+	if i := strings.LastIndex(selector, "."); i >= 0 {
+		name = selector[i+1:]
+	}
+
+	if FindMetric(name) == nil {
+		return fmt.Errorf("unknown metric %s in %s", name, selector)
+	}
+
+	return nil
+}
+
+// FindMetric returns the supported metric named name, or nil if there is none.
+func FindMetric(name string) *SwitchBotMetric {
+	for _, supports := range SupportedMetrics {
+		for _, support := range supports {
+			if support.Name == name {
+				return support
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,2112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/nasa9084/go-switchbot/v4"
+)
+
+func TestGetTimeout(t *testing.T) {
+	p := SwitchBotPlugin{
+		Timeout:        10 * time.Second,
+		DeviceTimeouts: map[string]time.Duration{"AA": 30 * time.Second, "BB": 0},
+	}
+
+	tests := map[string]time.Duration{
+		"AA": 30 * time.Second,
+		"BB": 0,
+		"CC": 10 * time.Second,
+	}
+	for target, want := range tests {
+		if got := p.GetTimeout(target); got != want {
+			t.Errorf("GetTimeout(%q) = %s, want %s", target, got, want)
+		}
+	}
+}
+
+func TestParseDeviceTimeouts(t *testing.T) {
+	timeouts, err := ParseDeviceTimeouts(" AA=30s, BB = 1m ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeouts) != 2 || timeouts["AA"] != 30*time.Second || timeouts["BB"] != time.Minute {
+		t.Errorf("ParseDeviceTimeouts() = %v", timeouts)
+	}
+
+	for _, s := range []string{"AA", "=30s", "AA=soon"} {
+		if _, err := ParseDeviceTimeouts(s); err == nil {
+			t.Errorf("ParseDeviceTimeouts(%q) succeeded", s)
+		}
+	}
+}
+
+// newTestPlugin returns a plugin with a Meter and a Meter Pro CO2 whose statuses are already fetched.
+func newTestPlugin(layout string) SwitchBotPlugin {
+	return SwitchBotPlugin{
+		Prefix:      "switchbot",
+		Targets:     []string{"AA", "BB"},
+		GraphLayout: layout,
+		Statuses: map[string]*DeviceStatus{
+			"AA": {DeviceStatus: &switchbot.DeviceStatus{ID: "AA", Type: switchbot.Meter, Battery: 90, Temperature: 21.5, Humidity: 40}},
+			"BB": {DeviceStatus: &switchbot.DeviceStatus{ID: "BB", Type: switchbot.MeterProCO2, Battery: 80, Temperature: 25, Humidity: 60, CO2: 800}},
+		},
+	}
+}
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+
+	return <-out
+}
+
+// parseValues parses the metric lines of go-mackerel-plugin by metric name, failing on names printed twice.
+func parseValues(t *testing.T, out string) map[string]float64 {
+	t.Helper()
+
+	values := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			t.Fatalf("malformed line %q", line)
+		}
+		if _, ok := values[fields[0]]; ok {
+			t.Errorf("%s is printed twice", fields[0])
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("malformed line %q: %s", line, err)
+		}
+		values[fields[0]] = value
+	}
+
+	return values
+}
+
+// outputValues runs p through go-mackerel-plugin and returns the values it prints.
+func outputValues(t *testing.T, p mp.Plugin) map[string]float64 {
+	t.Helper()
+
+	helper := mp.NewMackerelPlugin(p)
+	helper.Tempfile = filepath.Join(t.TempDir(), "tempfile")
+
+	return parseValues(t, captureStdout(t, helper.OutputValues))
+}
+
+// TestMetricKeysMatchGraphDefinitions checks that go-mackerel-plugin prints every metric FetchMetrics returns once.
+func TestMetricKeysMatchGraphDefinitions(t *testing.T) {
+	for _, layout := range []string{GraphLayoutFlat, GraphLayoutGrouped, GraphLayoutUnit, GraphLayoutDevice} {
+		t.Run(layout, func(t *testing.T) {
+			p := newTestPlugin(layout)
+			p.ValidRanges = DefaultValidRanges
+			p.Statuses["BB"].CO2 = 20000        // also emits co2_invalid, which must not be printed as co2
+			p.Targets = append(p.Targets, "CC") // failed, so it only reports online
+
+			metrics, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values := outputValues(t, p)
+			if len(values) != len(metrics) {
+				t.Errorf("%d of %d metrics are printed: %v", len(values), len(metrics), values)
+			}
+			if got := values["switchbot.AA.battery"] + values["switchbot.battery.AA"] + values["switchbot.percentage.battery.AA"]; got != 90 {
+				t.Errorf("battery of AA = %v, want 90", got)
+			}
+		})
+	}
+}
+
+func TestChildLock(t *testing.T) {
+	for _, deviceType := range []switchbot.PhysicalDeviceType{switchbot.Humidifier, "Humidifier2"} {
+		p := SwitchBotPlugin{
+			Targets: []string{"AA", "BB", "CC"},
+			Statuses: map[string]*DeviceStatus{
+				"AA": newStatus(switchbot.DeviceStatus{ID: "AA", Type: deviceType, IsChildLock: true}, ""),
+				"BB": newStatus(switchbot.DeviceStatus{ID: "BB", Type: deviceType}, ""),
+				"CC": newStatus(switchbot.DeviceStatus{ID: "CC", Type: switchbot.Meter}, ""),
+			},
+		}
+
+		metrics, err := p.FetchMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if metrics["AA.child_lock"] != 1 || metrics["BB.child_lock"] != 0 {
+			t.Errorf("%s: child_lock = %v and %v, want 1 and 0", deviceType, metrics["AA.child_lock"], metrics["BB.child_lock"])
+		}
+		if _, ok := metrics["CC.child_lock"]; ok {
+			t.Error("child_lock of a Meter is emitted")
+		}
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	tests := []struct {
+		transform Transform
+		value     float64
+		unit      string
+		want      float64
+	}{
+		{Transform{Scale: 1, Offset: -0.5}, 21.3, mp.UnitFloat, 20.8},
+		{Transform{Scale: 1.1, Offset: 0}, 50, mp.UnitInteger, 55},
+		{Transform{Scale: 1, Offset: 0.4}, 50, mp.UnitInteger, 50},
+		{Transform{Scale: 1, Offset: 0.5}, 50, mp.UnitInteger, 51},
+	}
+
+	for _, tt := range tests {
+		if got := tt.transform.Apply(tt.value, tt.unit); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v.Apply(%v, %s) = %v, want %v", tt.transform, tt.value, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	transforms, err := ParseTransforms("temperature=1:-1, AA.temperature=2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.Transforms = transforms
+
+	metrics, _ := p.FetchMetrics()
+	// the per-device transform takes precedence over the one of the metric
+	if metrics["AA.temperature"] != 43 || metrics["BB.temperature"] != 24 {
+		t.Errorf("temperature = %v and %v, want 43 and 24", metrics["AA.temperature"], metrics["BB.temperature"])
+	}
+
+	for _, s := range []string{"nope=1:0", "temperature=1", "temperature=a:0", "temperature=1:b"} {
+		if _, err := ParseTransforms(s); err == nil {
+			t.Errorf("ParseTransforms(%q) succeeded", s)
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestMetricNames checks that MetricNames names metrics the way go-mackerel-plugin prints them.
+func TestMetricNames(t *testing.T) {
+	for _, layout := range []string{GraphLayoutFlat, GraphLayoutGrouped, GraphLayoutUnit, GraphLayoutDevice} {
+		p := newTestPlugin(layout)
+
+		metrics, _ := p.FetchMetrics()
+		// go-mackerel-plugin prints six decimals
+		got, want := p.MetricNames(metrics), outputValues(t, p)
+		if !maps.EqualFunc(got, want, func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }) {
+			t.Errorf("%s: MetricNames() = %v, want %v", layout, got, want)
+		}
+	}
+}
+
+func TestServicePoster(t *testing.T) {
+	var posted []serviceMetricValue
+	poster := ServicePoster{
+		APIKey:      "key",
+		ServiceName: "home",
+		MetricNames: []string{"battery"},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path != "/api/v0/services/home/tsdb" || req.Header.Get("X-Api-Key") != "key" {
+				t.Errorf("posted to %s with key %q", req.URL, req.Header.Get("X-Api-Key"))
+			}
+			if err := json.NewDecoder(req.Body).Decode(&posted); err != nil {
+				t.Error(err)
+			}
+
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		})},
+	}
+
+	now := time.Unix(1700000000, 0)
+	err := poster.Post(map[string]float64{"switchbot.AA.battery": 90, "switchbot.AA.temperature": 21.5}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []serviceMetricValue{{Name: "switchbot.AA.battery", Time: now.Unix(), Value: 90}}
+	if !slices.Equal(posted, want) {
+		t.Errorf("posted %v, want %v", posted, want)
+	}
+}
+
+// newTestServer serves the switchbot api from handler, returning a client going through a ResponseRecorder.
+func newTestServer(t testing.TB, handler http.HandlerFunc) (SwitchBotClient, *ResponseRecorder) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	recorder := &ResponseRecorder{}
+	c := switchbot.New("token", "secret", switchbot.WithEndpoint(server.URL), switchbot.WithHTTPClient(&http.Client{Transport: recorder}))
+
+	return NewSwitchBotClient(c, recorder), recorder
+}
+
+// writeStatus writes a successful status response with body.
+func writeStatus(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"statusCode":100,"message":"success","body":%s}`, body)
+}
+
+func TestFetchStatusRetriesRateLimitedCalls(t *testing.T) {
+	calls := 0
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		writeStatus(w, `{"deviceId":"AA","deviceType":"Meter","battery":90}`)
+	})
+
+	p := SwitchBotPlugin{SwitchBotClient: c, Recorder: recorder, MaxRetries: 2}
+	status, err := p.FetchStatus(context.Background(), "AA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Battery != 90 || calls != 2 || recorder.Calls() != 2 {
+		t.Errorf("battery %d after %d calls (%d recorded), want 90 after 2", status.Battery, calls, recorder.Calls())
+	}
+}
+
+func TestFetchStatusStopsWhenRetryBudgetIsExhausted(t *testing.T) {
+	calls := 0
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	p := SwitchBotPlugin{SwitchBotClient: c, Recorder: recorder, MaxRetries: 5, RetryBudget: NewRetryBudget(1)}
+	if _, err := p.FetchStatus(context.Background(), "AA"); err == nil {
+		t.Fatal("FetchStatus succeeded")
+	}
+
+	if calls != 2 {
+		t.Errorf("%d calls, want 2 (one retry)", calls)
+	}
+}
+
+func TestFetchStatusDoesNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	p := SwitchBotPlugin{SwitchBotClient: c, MaxRetries: 2}
+	if _, err := p.FetchStatus(context.Background(), "AA"); err == nil || calls != 1 {
+		t.Errorf("FetchStatus() = %v after %d calls, want the failure without retrying", err, calls)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var unlimited *RetryBudget
+	if !unlimited.Take() {
+		t.Error("nil budget denies retries")
+	}
+	if NewRetryBudget(0) != nil {
+		t.Error("NewRetryBudget(0) is not unlimited")
+	}
+
+	budget := NewRetryBudget(2)
+	got := []bool{budget.Take(), budget.Take(), budget.Take()}
+	if want := []bool{true, true, false}; !slices.Equal(got, want) {
+		t.Errorf("Take() = %v, want %v", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{RetryInterval, 2 * RetryInterval, 4 * RetryInterval} {
+		if got := Backoff(attempt); got < want/2 || got > want {
+			t.Errorf("Backoff(%d) = %s, want between %s and %s", attempt, got, want/2, want)
+		}
+	}
+	if got := Backoff(100); got > MaxRetryInterval {
+		t.Errorf("Backoff(100) = %s, want at most %s", got, MaxRetryInterval)
+	}
+}
+
+func TestSkipZero(t *testing.T) {
+	skipZero, err := ParseMetricSelectors("co2, AA.humidity")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.SkipZero = skipZero
+	p.Statuses["AA"].Humidity = 0
+	p.Statuses["BB"].Humidity = 0
+	p.Statuses["BB"].CO2 = 0
+
+	metrics, _ := p.FetchMetrics()
+	for _, key := range []string{"AA.humidity", "BB.co2"} {
+		if _, ok := metrics[key]; ok {
+			t.Errorf("zero %s is emitted", key)
+		}
+	}
+	// the zeroed fields do not drop the real ones, nor the zeros not selected
+	for key, want := range map[string]float64{"AA.temperature": 21.5, "BB.temperature": 25, "BB.humidity": 0} {
+		if got, ok := metrics[key]; !ok || got != want {
+			t.Errorf("%s = %v (%v), want %v", key, got, ok, want)
+		}
+	}
+
+	if _, err := ParseMetricSelectors("AA.nope"); err == nil {
+		t.Error("ParseMetricSelectors(\"AA.nope\") succeeded")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	recorder := &ResponseRecorder{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().Add(-90*time.Second).UTC().Format(http.TimeFormat))
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+	})}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.Recorder = recorder
+	if metrics, _ := p.FetchMetrics(); metrics["clock_skew_seconds"] != 0 {
+		t.Errorf("clock_skew_seconds = %v before any response, want 0", metrics["clock_skew_seconds"])
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://switchbot.invalid", nil)
+	if _, err := (&http.Client{Transport: recorder}).Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Date header is truncated to seconds, so the skew is 90 or 91 seconds
+	if metrics, _ := p.FetchMetrics(); metrics["clock_skew_seconds"] < 90 || metrics["clock_skew_seconds"] > 91 {
+		t.Errorf("clock_skew_seconds = %v, want about 90", metrics["clock_skew_seconds"])
+	}
+}
+
+func TestParseDevices(t *testing.T) {
+	got := ParseDevices("AA, BB\n\nCC,AA,\r\n")
+	if want := []string{"AA", "BB", "CC"}; !slices.Equal(got, want) {
+		t.Errorf("ParseDevices() = %v, want %v", got, want)
+	}
+}
+
+func TestCurtainGraphs(t *testing.T) {
+	p := SwitchBotPlugin{
+		Targets:     []string{"AA"},
+		GraphLayout: GraphLayoutGrouped,
+		Statuses: map[string]*DeviceStatus{
+			"AA": {DeviceStatus: &switchbot.DeviceStatus{ID: "AA", Type: "Curtain3", Battery: 70, SlidePosition: 40}},
+		},
+	}
+
+	graphs := p.GraphDefinition()
+	for _, key := range []string{"switchbot.battery", "switchbot.slide_position"} {
+		if graph, ok := graphs[key]; !ok || graph.Unit != mp.UnitPercentage {
+			t.Errorf("graph %s = %+v (%v), want a percentage graph", key, graph, ok)
+		}
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["switchbot.slide_position.AA"] != 40 || metrics["switchbot.battery.AA"] != 70 {
+		t.Errorf("metrics = %v", metrics)
+	}
+}
+
+func TestCalculatePowerFactor(t *testing.T) {
+	tests := []struct {
+		power, voltage, current float64
+		want                    float64
+		ok                      bool
+	}{
+		{50, 100, 1, 0.5, true},
+		{150, 100, 1, 1, true},
+		{0, 100, 1, 0, false},
+		{50, 0, 1, 0, false},
+		{50, 100, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := CalculatePowerFactor(tt.power, tt.voltage, tt.current)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("CalculatePowerFactor(%v, %v, %v) = %v, %v, want %v, %v", tt.power, tt.voltage, tt.current, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPowerFactor(t *testing.T) {
+	p := SwitchBotPlugin{
+		Targets: []string{"AA", "BB"},
+		Statuses: map[string]*DeviceStatus{
+			"AA": {DeviceStatus: &switchbot.DeviceStatus{ID: "AA", Type: switchbot.PlugMiniJP, Weight: 80, Voltage: 100, ElectricCurrent: 1}},
+			"BB": {DeviceStatus: &switchbot.DeviceStatus{ID: "BB", Type: switchbot.PlugMiniJP, Voltage: 100}},
+		},
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["AA.power_factor"] != 0.8 {
+		t.Errorf("power_factor = %v, want 0.8", metrics["AA.power_factor"])
+	}
+	if _, ok := metrics["BB.power_factor"]; ok {
+		t.Error("power_factor of an idle plug is emitted")
+	}
+}
+
+func TestUnits(t *testing.T) {
+	units, err := ParseUnits("co2=float")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutGrouped)
+	p.Units = units
+
+	graphs := p.GraphDefinition()
+	if unit := graphs["switchbot.co2"].Unit; unit != mp.UnitFloat {
+		t.Errorf("unit of co2 = %s, want the override %s", unit, mp.UnitFloat)
+	}
+	if unit := graphs["switchbot.battery"].Unit; unit != mp.UnitPercentage {
+		t.Errorf("unit of battery = %s, want %s", unit, mp.UnitPercentage)
+	}
+
+	p.GraphLayout = GraphLayoutUnit
+	graphs = p.GraphDefinition()
+	hasCO2 := func(m mp.Metrics) bool { return m.Name == "co2.*" }
+	if graph := graphs["switchbot.float"]; graph.Unit != mp.UnitFloat || !slices.ContainsFunc(graph.Metrics, hasCO2) {
+		t.Errorf("graph of the overridden unit = %+v, want it to carry co2", graph)
+	}
+	if slices.ContainsFunc(graphs["switchbot.integer"].Metrics, hasCO2) {
+		t.Error("co2 is still graphed with its default unit")
+	}
+	if key := p.MetricKey("BB", CO2); key != "switchbot.float.co2.BB" {
+		t.Errorf("MetricKey of co2 = %s, want it under the overridden unit", key)
+	}
+
+	for _, s := range []string{"nope=integer", "co2=ppm"} {
+		if _, err := ParseUnits(s); err == nil {
+			t.Errorf("ParseUnits(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCalculateHumidex(t *testing.T) {
+	tests := []struct {
+		temperature, humidity float64
+		want                  float64
+	}{
+		// from the Environment Canada humidex table
+		{30, 70, 41},
+		{25, 50, 29},
+		{20, 30, 19},
+	}
+
+	for _, tt := range tests {
+		if got := CalculateHumidex(tt.temperature, tt.humidity); math.Abs(got-tt.want) > 1 {
+			t.Errorf("CalculateHumidex(%v, %v) = %v, want about %v", tt.temperature, tt.humidity, got, tt.want)
+		}
+	}
+}
+
+func TestComfortIndex(t *testing.T) {
+	p := newTestPlugin(GraphLayoutFlat)
+	p.Statuses["AA"].Humidity = 0
+
+	metrics, _ := p.FetchMetrics()
+	if _, ok := metrics["AA.comfort_index"]; ok {
+		t.Error("comfort_index without humidity is emitted")
+	}
+	if got, want := metrics["BB.comfort_index"], CalculateHumidex(25, 60); got != want {
+		t.Errorf("comfort_index = %v, want %v", got, want)
+	}
+}
+
+func TestLogUnsupportedDevices(t *testing.T) {
+	var logs bytes.Buffer
+	devices := []switchbot.Device{
+		{ID: "AA", Type: "Meter Ultra"},
+		{ID: "BB", Type: switchbot.Meter},
+		{ID: "CC", Type: "Meter Ultra"},
+	}
+
+	LogUnsupportedDevices(log.New(&logs, "", 0), []string{"AA", "BB"}, devices)
+
+	if !strings.Contains(logs.String(), `device AA is of type "Meter Ultra"`) {
+		t.Errorf("unsupported type is not logged: %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "BB") || strings.Contains(logs.String(), "CC") {
+		t.Errorf("supported or untargeted devices are logged: %q", logs.String())
+	}
+}
+
+func TestClosedThreshold(t *testing.T) {
+	tests := []struct {
+		metric   *SwitchBotMetric
+		position int
+		want     float64
+	}{
+		{CurtainClosed, 100, 1},
+		{CurtainClosed, 95, 1},
+		{CurtainClosed, 94, 0},
+		{CurtainClosed, 0, 0},
+		{BlindTiltClosed, 0, 1},
+		{BlindTiltClosed, 5, 1},
+		{BlindTiltClosed, 6, 0},
+		{BlindTiltClosed, 50, 0},
+		{BlindTiltClosed, 94, 0},
+		{BlindTiltClosed, 95, 1},
+	}
+
+	for _, tt := range tests {
+		status := &DeviceStatus{DeviceStatus: &switchbot.DeviceStatus{SlidePosition: tt.position}}
+		if got := tt.metric.ValueFunc(status); got != tt.want {
+			t.Errorf("%s at %d = %v, want %v", tt.metric.Name, tt.position, got, tt.want)
+		}
+	}
+}
+
+func TestBatterySentinels(t *testing.T) {
+	tests := map[int]bool{-1: false, 255: false, 0: true, 100: true}
+
+	for battery, want := range tests {
+		status := &DeviceStatus{DeviceStatus: &switchbot.DeviceStatus{Battery: battery}}
+		if got := Battery.AvailableFunc(status); got != want {
+			t.Errorf("battery %d available = %v, want %v", battery, got, want)
+		}
+	}
+
+	if got, err := ParseInts(" -1, 255,,0"); err != nil || !slices.Equal(got, []int{-1, 255, 0}) {
+		t.Errorf("ParseInts() = %v, %v", got, err)
+	}
+	if _, err := ParseInts("-1,full"); err == nil {
+		t.Error("ParseInts(\"-1,full\") succeeded")
+	}
+}
+
+func TestBuildDashboard(t *testing.T) {
+	p := newTestPlugin(GraphLayoutGrouped)
+	graphs := p.GraphDefinition()
+
+	dashboard := p.BuildDashboard("host")
+	if len(dashboard.Widgets) != len(graphs) {
+		t.Fatalf("%d widgets for %d graphs", len(dashboard.Widgets), len(graphs))
+	}
+
+	for i, widget := range dashboard.Widgets {
+		key := strings.TrimPrefix(widget.Graph.Name, "custom.")
+		if _, ok := graphs[key]; !ok || widget.Graph.HostID != "host" {
+			t.Errorf("widget %+v shows no graph of the plugin", widget.Graph)
+		}
+		if want := (i % 2) * 12; widget.Layout.X != want {
+			t.Errorf("widget %d is at x %d, want %d", i, widget.Layout.X, want)
+		}
+	}
+}
+
+func TestPollLatency(t *testing.T) {
+	c := &fakeClient{
+		statuses: map[string]switchbot.DeviceStatus{
+			"AA": {ID: "AA", Type: switchbot.Meter, Battery: 90},
+			"BB": {ID: "BB", Type: switchbot.Meter, Battery: 90},
+		},
+		delays: map[string]time.Duration{"BB": 100 * time.Millisecond},
+	}
+
+	p := SwitchBotPlugin{
+		SwitchBotClient: c,
+		Targets:         []string{"AA", "BB"},
+		Concurrency:     2,
+		Statuses:        map[string]*DeviceStatus{},
+		Latencies:       map[string]time.Duration{},
+	}
+	if err := p.FetchStatuses(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Latencies["BB"] < 100*time.Millisecond || p.Latencies["AA"] >= 100*time.Millisecond {
+		t.Errorf("latencies = %v, want at least 100ms for BB only", p.Latencies)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if latency := metrics["BB.poll_latency_ms"]; latency < 100 {
+		t.Errorf("poll_latency_ms of the slow device = %v, want at least 100", latency)
+	}
+	if latency, ok := metrics["AA.poll_latency_ms"]; !ok || latency >= 100 {
+		t.Errorf("poll_latency_ms of the fast device = %v (%v), want below 100", latency, ok)
+	}
+}
+
+func TestRunBuffered(t *testing.T) {
+	c := &fakeClient{statuses: map[string]switchbot.DeviceStatus{}}
+	p := SwitchBotPlugin{Concurrency: 16, Statuses: map[string]*DeviceStatus{}, Latencies: map[string]time.Duration{}}
+	for i := range 500 {
+		id := fmt.Sprintf("D%03d", i)
+		p.Targets = append(p.Targets, id)
+		c.statuses[id] = switchbot.DeviceStatus{ID: id, Type: switchbot.Meter, Battery: i % 100, Temperature: 20, Humidity: 50}
+	}
+	p.SwitchBotClient = c
+
+	if err := p.FetchStatuses(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	helper := mp.NewMackerelPlugin(p)
+	helper.Tempfile = filepath.Join(t.TempDir(), "tempfile")
+
+	out := captureStdout(t, func() {
+		if err := RunBuffered(helper); err != nil {
+			t.Error(err)
+		}
+	})
+	if !strings.HasSuffix(out, "\n") {
+		t.Error("output does not end with a newline")
+	}
+
+	values := parseValues(t, out)
+	metrics, _ := p.FetchMetrics()
+	if len(values) != len(metrics) {
+		t.Errorf("%d of %d metrics are printed", len(values), len(metrics))
+	}
+	for i := range 500 {
+		key := fmt.Sprintf("switchbot.D%03d.battery", i)
+		if values[key] != float64(i%100) {
+			t.Errorf("%s = %v, want %d", key, values[key], i%100)
+		}
+	}
+}
+
+func TestInvalidMetrics(t *testing.T) {
+	p := newTestPlugin(GraphLayoutFlat)
+	p.ValidRanges = DefaultValidRanges
+	p.Statuses["AA"].Temperature = 120
+	p.Statuses["BB"].Humidity = 101
+
+	metrics, _ := p.FetchMetrics()
+	for _, key := range []string{"AA.temperature", "BB.humidity"} {
+		if _, ok := metrics[key]; ok {
+			t.Errorf("out of range %s is emitted", key)
+		}
+	}
+
+	want := map[string]float64{
+		"AA.temperature_invalid": 1,
+		"AA.humidity_invalid":    0,
+		"AA.humidity":            40,
+		"BB.temperature_invalid": 0,
+		"BB.humidity_invalid":    1,
+	}
+	for key, value := range want {
+		if got, ok := metrics[key]; !ok || got != value {
+			t.Errorf("%s = %v (%v), want %v", key, got, ok, value)
+		}
+	}
+}
+
+func TestParseValidRanges(t *testing.T) {
+	ranges, err := ParseValidRanges("humidity=10:90")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges["humidity"] != (ValidRange{Min: 10, Max: 90}) || ranges["temperature"] != DefaultValidRanges["temperature"] {
+		t.Errorf("ParseValidRanges() = %v", ranges)
+	}
+
+	for _, s := range []string{"nope=0:1", "humidity=10", "humidity=a:1", "humidity=90:10"} {
+		if _, err := ParseValidRanges(s); err == nil {
+			t.Errorf("ParseValidRanges(%q) succeeded", s)
+		}
+	}
+}
+
+func newStatus(status switchbot.DeviceStatus, raw string) *DeviceStatus {
+	s := &DeviceStatus{DeviceStatus: &status}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &s.Raw); err != nil {
+			panic(err)
+		}
+	}
+
+	return s
+}
+
+func TestLeakStatus(t *testing.T) {
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, `{"deviceId":"AA","deviceType":"Water Detector","battery":100,"status":1}`)
+	})
+
+	p := SwitchBotPlugin{
+		SwitchBotClient: c,
+		Recorder:        recorder,
+		Targets:         []string{"AA"},
+		Statuses:        map[string]*DeviceStatus{},
+		Latencies:       map[string]time.Duration{},
+	}
+	if err := p.FetchStatuses(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["AA.leak_status"] != 1 || metrics["AA.battery"] != 100 {
+		t.Errorf("leak_status = %v, battery = %v, want 1 and 100", metrics["AA.leak_status"], metrics["AA.battery"])
+	}
+
+	// an absent status is not reported as dry
+	if LeakStatus.AvailableFunc(newStatus(switchbot.DeviceStatus{Type: "Water Detector"}, `{"battery": 100}`)) {
+		t.Error("leak_status without status is emitted")
+	}
+}
+
+func TestHumidifier2Metrics(t *testing.T) {
+	want := []*SwitchBotMetric{Humidity, ChildLock, PowerState, FilterLife, Online}
+	if got := SupportedMetrics["Humidifier2"]; !slices.Equal(got, want) {
+		t.Errorf("metrics of Humidifier2 = %v, want %v", got, want)
+	}
+}
+
+func TestCirculatorFan(t *testing.T) {
+	status := newStatus(switchbot.DeviceStatus{Type: "Circulator Fan"}, `{"fanSpeed": 50, "oscillation": "on"}`)
+	if got := FanSpeed.ValueFunc(status); got != 50 {
+		t.Errorf("fan_speed = %v, want 50", got)
+	}
+	if !OscillationState.AvailableFunc(status) || OscillationState.ValueFunc(status) != 1 {
+		t.Error("oscillation_state of an oscillating fan is not 1")
+	}
+
+	// fans decoded by go-switchbot report their speed as before
+	if got := FanSpeed.ValueFunc(newStatus(switchbot.DeviceStatus{FanSpeed: 30}, "")); got != 30 {
+		t.Errorf("fan_speed = %v, want 30", got)
+	}
+	if OscillationState.AvailableFunc(newStatus(switchbot.DeviceStatus{}, `{"fanSpeed": 30}`)) {
+		t.Error("oscillation_state without oscillation is emitted")
+	}
+}
+
+func TestPower(t *testing.T) {
+	tests := []struct {
+		name   string
+		status *DeviceStatus
+		want   float64
+	}{
+		{"plug mini", newStatus(switchbot.DeviceStatus{Weight: 12.5}, `{"power": "on", "weight": 12.5}`), 12.5},
+		{"relay switch 1pm", newStatus(switchbot.DeviceStatus{}, `{"power": 30.2, "switchStatus": 1}`), 30.2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Power.ValueFunc(tt.status); got != tt.want {
+				t.Errorf("power = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if SwitchStatus.AvailableFunc(tests[0].status) {
+		t.Error("switch_status of a plug mini is emitted")
+	}
+	if !SwitchStatus.AvailableFunc(tests[1].status) || SwitchStatus.ValueFunc(tests[1].status) != 1 {
+		t.Error("switch_status of a switched on relay is not 1")
+	}
+}
+
+func TestOnline(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want float64
+	}{
+		{"fetched device", `{}`, 1},
+		{"online vacuum", `{"onlineStatus": "online"}`, 1},
+		{"offline vacuum", `{"onlineStatus": "offline"}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Online.ValueFunc(newStatus(switchbot.DeviceStatus{}, tt.raw)); got != tt.want {
+				t.Errorf("online = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for deviceType, metrics := range SupportedMetrics {
+		if !slices.Contains(metrics, Online) {
+			t.Errorf("online is not supported by %s", deviceType)
+		}
+	}
+}
+
+func TestLockState(t *testing.T) {
+	tests := []struct {
+		state     string
+		want      float64
+		available bool
+	}{
+		{"unlocked", 0, true},
+		{"locked", 1, true},
+		{"jammed", 2, true},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			status := newStatus(switchbot.DeviceStatus{LockState: tt.state}, "")
+			if got := LockState.AvailableFunc(status); got != tt.available {
+				t.Fatalf("lock_state available = %v, want %v", got, tt.available)
+			}
+			if got := LockState.ValueFunc(status); got != tt.want {
+				t.Errorf("lock_state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContactState(t *testing.T) {
+	tests := []struct {
+		state     switchbot.OpenState
+		want      float64
+		available bool
+	}{
+		{"open", 1, true},
+		{"close", 0, true},
+		{"timeOutNotClose", 2, true},
+		{"unknown", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.state), func(t *testing.T) {
+			status := newStatus(switchbot.DeviceStatus{OpenState: tt.state}, "")
+			if got := ContactState.AvailableFunc(status); got != tt.available {
+				t.Fatalf("contact_state available = %v, want %v", got, tt.available)
+			}
+			if got := ContactState.ValueFunc(status); got != tt.want {
+				t.Errorf("contact_state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmbientBright(t *testing.T) {
+	tests := []struct {
+		body      string
+		want      float64
+		available bool
+	}{
+		{`{"brightness": "bright"}`, 1, true},
+		{`{"brightness": "dim"}`, 0, true},
+		{`{"brightness": 50}`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			var status switchbot.DeviceStatus
+			if err := json.Unmarshal([]byte(tt.body), &status); err != nil {
+				t.Fatal(err)
+			}
+			s := newStatus(status, tt.body)
+			if got := AmbientBright.AvailableFunc(s); got != tt.available {
+				t.Fatalf("ambient_bright available = %v, want %v", got, tt.available)
+			}
+			if got := AmbientBright.ValueFunc(s); got != tt.want {
+				t.Errorf("ambient_bright = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMotionDetected(t *testing.T) {
+	if got := MotionDetected.ValueFunc(newStatus(switchbot.DeviceStatus{IsMoveDetected: true}, "")); got != 1 {
+		t.Errorf("motion_detected = %v, want 1", got)
+	}
+	if got := MotionDetected.ValueFunc(newStatus(switchbot.DeviceStatus{}, "")); got != 0 {
+		t.Errorf("motion_detected = %v, want 0", got)
+	}
+	if !slices.Contains(SupportedMetrics[switchbot.MotionSensor], MotionDetected) {
+		t.Error("motion_detected is not supported by Motion Sensor")
+	}
+}
+
+func BenchmarkFetchStatuses(b *testing.B) {
+	// every status call takes a while, as the cloud api does
+	c := &fakeClient{statuses: map[string]switchbot.DeviceStatus{}, delays: map[string]time.Duration{}}
+	targets := make([]string, 16)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("D%02d", i)
+		c.statuses[targets[i]] = switchbot.DeviceStatus{ID: targets[i], Type: switchbot.Meter, Battery: 90}
+		c.delays[targets[i]] = 10 * time.Millisecond
+	}
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(concurrency), func(b *testing.B) {
+			for range b.N {
+				p := SwitchBotPlugin{
+					SwitchBotClient: c,
+					Targets:         targets,
+					Concurrency:     concurrency,
+					Statuses:        map[string]*DeviceStatus{},
+					Latencies:       map[string]time.Duration{},
+				}
+				if err := p.FetchStatuses(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchStatusTimeout(t *testing.T) {
+	c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// a device that never answers within the timeout
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	p := SwitchBotPlugin{
+		SwitchBotClient: c,
+		Timeout:         50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := p.FetchStatus(context.Background(), "AA")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FetchStatus() took %s, want the 50ms timeout to be honored", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("FetchStatus() = %v, want a timed out error", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FetchStatus() = %v, want it to wrap context.DeadlineExceeded", err)
+	}
+}
+
+func TestFetchStatusDoesNotRetryTimeouts(t *testing.T) {
+	var calls atomic.Int32
+	c, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	p := SwitchBotPlugin{
+		SwitchBotClient: c,
+		Timeout:         50 * time.Millisecond,
+		MaxRetries:      2,
+	}
+
+	if _, err := p.FetchStatus(context.Background(), "AA"); err == nil {
+		t.Fatal("FetchStatus() succeeded")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("status called %d times, want a timed out call not to be retried", n)
+	}
+}
+
+func TestLabelByName(t *testing.T) {
+	p := newTestPlugin(GraphLayoutFlat)
+	p.DeviceNames = map[string]string{"AA": "Living Room", "BB": "Office"}
+	p.DeviceKeys = ResolveDeviceKeys(p.Targets, p.DeviceNames)
+
+	metrics, _ := p.FetchMetrics()
+	for _, key := range []string{"Living_Room.battery", "Office.co2"} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("%s is missing: %v", key, metrics)
+		}
+	}
+	if _, ok := metrics["AA.battery"]; ok {
+		t.Error("AA.battery is keyed by id with -label-by-name")
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := map[string]string{
+		"Living Room":  "Living_Room",
+		"bed.room #2":  "bed_room_2",
+		"リビング":         "",
+		"  kitchen-1 ": "kitchen-1",
+	}
+
+	for name, want := range tests {
+		if got := SanitizeMetricName(name); got != want {
+			t.Errorf("SanitizeMetricName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestResolveDeviceKeys(t *testing.T) {
+	targets := []string{"AA", "BB", "CC", "DD", "EE", "FF"}
+	names := map[string]string{
+		"AA": "Living Room",
+		"BB": "Bed Room",
+		"CC": "Bed.Room",
+		"DD": "寝室",
+		"EE": "FF",
+	}
+
+	got := ResolveDeviceKeys(targets, names)
+	// BB and CC collide, DD sanitizes to nothing, EE would take the id of FF and FF has no name
+	want := map[string]string{"AA": "Living_Room"}
+	if len(got) != len(want) || got["AA"] != want["AA"] {
+		t.Errorf("ResolveDeviceKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestUnitGraphDefinition(t *testing.T) {
+	p := SwitchBotPlugin{
+		Targets:     []string{"AA", "BB"},
+		GraphLayout: GraphLayoutUnit,
+		Statuses: map[string]*DeviceStatus{
+			"AA": newStatus(switchbot.DeviceStatus{ID: "AA", Type: switchbot.Bot, Battery: 90}, ""),
+			"BB": newStatus(switchbot.DeviceStatus{ID: "BB", Type: switchbot.Hub2, Temperature: 21.5, Humidity: 40}, ""),
+		},
+	}
+
+	graphs := p.GraphDefinition()
+	tests := map[string]struct {
+		unit   string
+		metric string
+	}{
+		"switchbot.percentage": {mp.UnitPercentage, "battery.*"},
+		"switchbot.float":      {mp.UnitFloat, "temperature.*"},
+	}
+	for key, tt := range tests {
+		graph, ok := graphs[key]
+		if !ok {
+			t.Errorf("%s is missing: %v", key, graphs)
+			continue
+		}
+		if graph.Unit != tt.unit {
+			t.Errorf("unit of %s = %s, want %s", key, graph.Unit, tt.unit)
+		}
+		if !slices.ContainsFunc(graph.Metrics, func(m mp.Metrics) bool { return m.Name == tt.metric }) {
+			t.Errorf("%s does not graph %s: %v", key, tt.metric, graph.Metrics)
+		}
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["switchbot.percentage.battery.AA"] != 90 || metrics["switchbot.float.temperature.BB"] != 21.5 {
+		t.Errorf("metrics = %v, want battery and temperature keyed by unit", metrics)
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	got := ParseDevices(StripComments("# living room\nAA # meter\n#BB\nCC\n"))
+	if want := []string{"AA", "CC"}; !slices.Equal(got, want) {
+		t.Errorf("devices = %v, want %v", got, want)
+	}
+}
+
+func TestFilterDevicesByType(t *testing.T) {
+	devices := []switchbot.Device{
+		{ID: "AA", Type: switchbot.Meter},
+		{ID: "BB", Type: switchbot.MeterPlus},
+		{ID: "CC", Type: switchbot.Bot},
+	}
+
+	got := FilterDevicesByType([]string{"CC", "BB", "AA", "IR"}, devices, []string{"meter", " MeterPlus "})
+	if want := []string{"BB", "AA"}; !slices.Equal(got, want) {
+		t.Errorf("FilterDevicesByType() = %v, want %v", got, want)
+	}
+}
+
+func TestFetchStatusesKeepsHealthyDevices(t *testing.T) {
+	c := &fakeClient{statuses: map[string]switchbot.DeviceStatus{
+		"AA": {ID: "AA", Type: switchbot.Meter, Battery: 50},
+		"CC": {ID: "CC", Type: switchbot.Bot, Battery: 60},
+	}}
+	p := newTestPlugin(GraphLayoutFlat)
+	p.Targets = []string{"AA", "BB", "CC"}
+	p.SwitchBotClient = c
+	p.Statuses = map[string]*DeviceStatus{}
+	p.Latencies = map[string]time.Duration{}
+
+	err := p.FetchStatuses(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "BB") {
+		t.Errorf("FetchStatuses() = %v, want the failure of BB", err)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["AA.battery"] != 50 || metrics["CC.battery"] != 60 {
+		t.Errorf("metrics of healthy devices are missing: %v", metrics)
+	}
+	if metrics["api_errors"] != 1 || metrics["devices_fetched"] != 2 {
+		t.Errorf("api_errors = %v, devices_fetched = %v, want 1 and 2", metrics["api_errors"], metrics["devices_fetched"])
+	}
+	if online, ok := metrics["BB.online"]; !ok || online != 0 || metrics["AA.online"] != 1 {
+		t.Errorf("online = %v (%v) and %v, want 0 for the failed device and 1 for the others", online, ok, metrics["AA.online"])
+	}
+}
+
+func TestWriteDevices(t *testing.T) {
+	devices := []switchbot.Device{
+		{ID: "AA", Type: switchbot.Meter, Name: "Living Room"},
+		{ID: "BBBB", Type: switchbot.Lock, Name: "Front Door"},
+	}
+
+	var table bytes.Buffer
+	if err := WriteDevicesTable(&table, devices); err != nil {
+		t.Fatal(err)
+	}
+	want := "ID    TYPE        NAME\nAA    Meter       Living Room\nBBBB  Smart Lock  Front Door\n"
+	if table.String() != want {
+		t.Errorf("WriteDevicesTable() = %q, want %q", table.String(), want)
+	}
+
+	var b bytes.Buffer
+	if err := WriteDevicesJSON(&b, devices); err != nil {
+		t.Fatal(err)
+	}
+	var listed []map[string]string
+	if err := json.Unmarshal(b.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[1]["id"] != "BBBB" || listed[1]["type"] != "Smart Lock" || listed[1]["name"] != "Front Door" {
+		t.Errorf("WriteDevicesJSON() = %s", b.String())
+	}
+
+	b.Reset()
+	if err := WriteDevicesJSON(&b, nil); err != nil || strings.TrimSpace(b.String()) != "[]" {
+		t.Errorf("WriteDevicesJSON(nil) = %s, %v, want an empty array", b.String(), err)
+	}
+}
+
+// fakeClient is a SwitchBotClient serving fixed statuses; devices missing from statuses fail.
+type fakeClient struct {
+	statuses map[string]switchbot.DeviceStatus
+	devices  []switchbot.Device
+	infrared []switchbot.InfraredDevice
+	listErr  error
+	// delays holds how long the status call of a device takes
+	delays map[string]time.Duration
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *fakeClient) Status(ctx context.Context, id string) (switchbot.DeviceStatus, error) {
+	c.mu.Lock()
+	c.calls = append(c.calls, id)
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return switchbot.DeviceStatus{}, ctx.Err()
+	case <-time.After(c.delays[id]):
+	}
+
+	status, ok := c.statuses[id]
+	if !ok {
+		return switchbot.DeviceStatus{}, fmt.Errorf("device %s is offline", id)
+	}
+
+	return status, nil
+}
+
+func (c *fakeClient) List(ctx context.Context) ([]switchbot.Device, []switchbot.InfraredDevice, error) {
+	c.mu.Lock()
+	c.calls = append(c.calls, "list")
+	c.mu.Unlock()
+
+	if c.listErr != nil {
+		return nil, nil, c.listErr
+	}
+
+	return c.devices, c.infrared, nil
+}
+
+func TestElectricityOfDayRate(t *testing.T) {
+	supported := maps.Clone(SupportedMetrics)
+	t.Cleanup(func() { SupportedMetrics = supported })
+	EnableDifferentialElectricity()
+
+	p := SwitchBotPlugin{
+		Targets:  []string{"AA"},
+		Statuses: map[string]*DeviceStatus{"AA": newStatus(switchbot.DeviceStatus{ID: "AA", Type: switchbot.PlugMiniJP, ElectricityOfDay: 1000}, "")},
+	}
+	tempfile := filepath.Join(t.TempDir(), "tempfile")
+
+	// run returns the printed values after moving the previous run a minute back
+	run := func(electricity int) map[string]float64 {
+		t.Helper()
+
+		if b, err := os.ReadFile(tempfile); err == nil {
+			var last map[string]float64
+			if err := json.Unmarshal(b, &last); err != nil {
+				t.Fatal(err)
+			}
+			last["_lastTime"] -= 60
+			b, _ = json.Marshal(last)
+			if err := os.WriteFile(tempfile, b, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		p.Statuses["AA"].ElectricityOfDay = electricity
+		// go-mackerel-plugin keeps the stdout it first wrote to, so every run needs its own helper
+		helper := mp.NewMackerelPlugin(p)
+		helper.Tempfile = tempfile
+		return parseValues(t, captureStdout(t, helper.OutputValues))
+	}
+
+	if _, ok := run(1000)["switchbot.AA.electricity_of_day_rate"]; ok {
+		t.Error("electricity_of_day_rate is printed without a previous run")
+	}
+	if rate := run(1060)["switchbot.AA.electricity_of_day_rate"]; rate <= 0 {
+		t.Errorf("electricity_of_day_rate = %v, want the increase per minute", rate)
+	}
+	// the counter starts over at midnight
+	if rate, ok := run(10)["switchbot.AA.electricity_of_day_rate"]; !ok || rate != 0 {
+		t.Errorf("electricity_of_day_rate after the reset = %v (%v), want 0", rate, ok)
+	}
+}
+
+func TestFahrenheit(t *testing.T) {
+	p := newTestPlugin(GraphLayoutFlat)
+	p.ValidRanges = DefaultValidRanges
+	p.TemperatureUnit = TemperatureFahrenheit
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["BB.temperature"] != 77 {
+		t.Errorf("25°C = %v°F, want 77", metrics["BB.temperature"])
+	}
+
+	humidex := CalculateHumidex(25, 60)
+	if got, want := metrics["BB.comfort_index"], CelsiusToFahrenheit(humidex); math.Abs(got-want) > 1e-9 {
+		t.Errorf("comfort_index = %v, want %v (%v°C)", got, want, humidex)
+	}
+
+	// valid ranges are checked in Celsius, before the conversion
+	p.Statuses["AA"].Temperature = 120
+	metrics, _ = p.FetchMetrics()
+	if _, ok := metrics["AA.temperature"]; ok || metrics["AA.temperature_invalid"] != 1 {
+		t.Errorf("120°C is emitted as %v°F", metrics["AA.temperature"])
+	}
+}
+
+func TestInfraredCount(t *testing.T) {
+	c := &fakeClient{
+		devices:  []switchbot.Device{{ID: "AA", Type: switchbot.Meter}},
+		infrared: []switchbot.InfraredDevice{{ID: "IR1"}, {ID: "IR2"}},
+	}
+	_, infrared, err := SwitchBotPlugin{SwitchBotClient: c, Timeout: time.Second}.FetchDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	metrics, _ := p.FetchMetrics()
+	if _, ok := metrics["infrared_device_count"]; ok {
+		t.Error("infrared_device_count is emitted without -infrared-count")
+	}
+
+	p.CountInfrared = true
+	p.InfraredDevices = infrared
+	metrics, _ = p.FetchMetrics()
+	if metrics["infrared_device_count"] != 2 {
+		t.Errorf("infrared_device_count = %v, want 2", metrics["infrared_device_count"])
+	}
+	if names := p.MetricNames(metrics); names["switchbot.meta.infrared_device_count"] != 2 {
+		t.Errorf("infrared_device_count is not graphed: %v", names)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	p := newTestPlugin(GraphLayoutGrouped)
+	p.Targets = append(p.Targets, "CC") // failed, so its type is unknown
+
+	var b bytes.Buffer
+	if err := p.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, line := range []string{
+		`switchbot_battery{device_id="AA",device_type="Meter"} 90`,
+		`switchbot_battery{device_id="BB",device_type="MeterPro(CO2)"} 80`,
+		`switchbot_co2{device_id="BB",device_type="MeterPro(CO2)"} 800`,
+		`switchbot_online{device_id="CC",device_type=""} 0`,
+		"switchbot_clock_skew_seconds 0",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("%q is missing from:\n%s", line, out)
+		}
+	}
+
+	// each family is described once, whatever the number of devices
+	if n := strings.Count(out, "# TYPE switchbot_battery gauge\n"); n != 1 {
+		t.Errorf("switchbot_battery is described %d times", n)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	p := newTestPlugin(GraphLayoutFlat)
+
+	var b bytes.Buffer
+	if err := p.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump struct {
+		Metrics     map[string]float64 `json:"metrics"`
+		DeviceTypes map[string]string  `json:"device_types"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if !maps.Equal(dump.Metrics, metrics) {
+		t.Errorf("metrics = %v, want %v", dump.Metrics, metrics)
+	}
+	if dump.DeviceTypes["AA"] != "Meter" || dump.DeviceTypes["BB"] != "MeterPro(CO2)" {
+		t.Errorf("device_types = %v", dump.DeviceTypes)
+	}
+}
+
+func TestDebugLog(t *testing.T) {
+	var b bytes.Buffer
+	debugLog.SetOutput(&b)
+	t.Cleanup(func() { debugLog.SetOutput(io.Discard) })
+
+	skipZero, err := ParseMetricSelectors("co2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.SkipZero = skipZero
+	p.Statuses["BB"].CO2 = 0
+	p.FetchMetrics()
+
+	if !strings.Contains(b.String(), "skipped co2 of BB: zero") {
+		t.Errorf("debug log = %q, want the skipped co2", b.String())
+	}
+}
+
+func TestMultiAccountClient(t *testing.T) {
+	first := &fakeClient{
+		statuses: map[string]switchbot.DeviceStatus{"AA": {ID: "AA", Battery: 10}},
+		devices:  []switchbot.Device{{ID: "AA"}},
+	}
+	second := &fakeClient{
+		statuses: map[string]switchbot.DeviceStatus{"BB": {ID: "BB", Battery: 20}},
+		devices:  []switchbot.Device{{ID: "BB"}},
+		infrared: []switchbot.InfraredDevice{{ID: "IR"}},
+	}
+	c := &MultiAccountClient{Clients: []SwitchBotClient{first, second}}
+
+	status, err := c.Status(context.Background(), "BB")
+	if err != nil || status.Battery != 20 {
+		t.Errorf("status of BB = %+v, %v, want the one of the second account", status, err)
+	}
+	if slices.Contains(first.calls, "BB") {
+		t.Error("status of BB is fetched from the first account")
+	}
+
+	if _, err := c.Status(context.Background(), "ZZ"); err == nil {
+		t.Error("status of a device of no account is fetched")
+	}
+
+	devices, infrared, err := c.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || len(infrared) != 1 {
+		t.Errorf("List() = %v, %v, want the devices of both accounts", devices, infrared)
+	}
+}
+
+func TestHubCO2(t *testing.T) {
+	with := newStatus(switchbot.DeviceStatus{Type: switchbot.Hub2, CO2: 650}, `{"CO2": 650}`)
+	if !HubCO2.AvailableFunc(with) || HubCO2.ValueFunc(with) != 650 {
+		t.Error("co2 of a Hub 2 reporting CO2 is not emitted")
+	}
+
+	without := newStatus(switchbot.DeviceStatus{Type: switchbot.Hub2}, `{"temperature": 21}`)
+	if HubCO2.AvailableFunc(without) {
+		t.Error("co2 of a Hub 2 without CO2 is emitted")
+	}
+}
+
+func TestRollerShadeMetrics(t *testing.T) {
+	want := []*SwitchBotMetric{Battery, SlidePosition, Online}
+	if got := SupportedMetrics["Roller Shade"]; !slices.Equal(got, want) {
+		t.Errorf("metrics of Roller Shade = %v, want %v", got, want)
+	}
+}
+
+func TestWorkingStatus(t *testing.T) {
+	tests := map[switchbot.CleanerWorkingStatus]float64{
+		switchbot.CleanerStandBy:          0,
+		switchbot.CleanerClearing:         1,
+		switchbot.CleanerInDustCollecting: 9,
+		"Flying":                          UnknownWorkingStatus,
+	}
+
+	for working, want := range tests {
+		status := newStatus(switchbot.DeviceStatus{WorkingStatus: working}, "")
+		if got := WorkingStatus.ValueFunc(status); got != want {
+			t.Errorf("working status %q = %v, want %v", working, got, want)
+		}
+	}
+
+	if WorkingStatus.AvailableFunc(newStatus(switchbot.DeviceStatus{}, "")) {
+		t.Error("missing working status is emitted")
+	}
+}
+
+func TestVacuumMetrics(t *testing.T) {
+	for _, deviceType := range []switchbot.PhysicalDeviceType{switchbot.RobotVacuumCleanerS1, switchbot.RobotVacuumCleanerS1Plus, "K10+", "K10+ Pro", "Robot Vacuum Cleaner K10+ Pro Combo", "Robot Vacuum Cleaner S10"} {
+		if !slices.Contains(SupportedMetrics[deviceType], WorkingStatus) {
+			t.Errorf("working_status is not supported by %s", deviceType)
+		}
+	}
+}
+
+func TestAPICalls(t *testing.T) {
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(r.URL.Path, "/")[3]
+		writeStatus(w, fmt.Sprintf(`{"deviceId":%q,"deviceType":"Meter","battery":90}`, id))
+	})
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.SwitchBotClient = c
+	p.Recorder = recorder
+	p.Statuses = map[string]*DeviceStatus{}
+	p.Latencies = map[string]time.Duration{}
+
+	if err := p.FetchStatuses(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if metrics["api_calls"] != 2 {
+		t.Errorf("api_calls = %v, want 2", metrics["api_calls"])
+	}
+}
+
+func TestQuotaRemaining(t *testing.T) {
+	remaining := 9990
+	recorder := &ResponseRecorder{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set(QuotaRemainingHeader, strconv.Itoa(remaining))
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody}, nil
+	})}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.Recorder = recorder
+	metrics, _ := p.FetchMetrics()
+	if _, ok := metrics["quota_remaining"]; ok {
+		t.Error("quota_remaining is emitted before any response")
+	}
+
+	client := &http.Client{Transport: recorder}
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, "http://switchbot.invalid", nil)
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		remaining--
+	}
+
+	// the latest response wins
+	metrics, _ = p.FetchMetrics()
+	if metrics["quota_remaining"] != 9989 {
+		t.Errorf("quota_remaining = %v, want 9989", metrics["quota_remaining"])
+	}
+	if names := p.MetricNames(metrics); names["switchbot.meta.quota_remaining"] != 9989 {
+		t.Errorf("quota_remaining is not graphed: %v", names)
+	}
+}
+
+func TestCheckDevices(t *testing.T) {
+	devices := []switchbot.Device{{ID: "AA"}, {ID: "BB"}}
+	infrared := []switchbot.InfraredDevice{{ID: "IR"}}
+
+	var b bytes.Buffer
+	if !CheckDevices(&b, []string{"AA", "BB"}, devices, infrared) {
+		t.Errorf("CheckDevices() failed: %s", b.String())
+	}
+
+	b.Reset()
+	if CheckDevices(&b, []string{"AA", "IR", "ZZ"}, devices, infrared) {
+		t.Error("CheckDevices() succeeded with an infrared remote and an unknown device")
+	}
+	want := "OK\tAA\nFAIL\tIR\tinfrared remotes have no status\nFAIL\tZZ\tnot found in the account\n"
+	if b.String() != want {
+		t.Errorf("CheckDevices() wrote %q, want %q", b.String(), want)
+	}
+}
+
+func TestKeyTemplateMatchesGraphDefinition(t *testing.T) {
+	tmpl, err := ParseKeyTemplate("{{.Prefix}}.dev_{{.DeviceID}}_{{.Metric}}", "switchbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.KeyTemplate = tmpl
+
+	metrics, _ := p.FetchMetrics()
+	if _, ok := metrics["dev_AA_battery"]; !ok {
+		t.Errorf("dev_AA_battery is missing: %v", metrics)
+	}
+	if names := p.MetricNames(metrics); len(names) != len(metrics) {
+		t.Errorf("%d of %d metrics match a graph", len(names), len(metrics))
+	}
+
+	for _, s := range []string{"{{.Prefix", "{{.Nope}}", "x.{{.Metric}}", "{{.Prefix}}.a b", "{{.Prefix}}.{{.Metric}}", "{{.Prefix}}.{{.Hub}}.{{.Metric}}"} {
+		if _, err := ParseKeyTemplate(s, "switchbot"); err == nil {
+			t.Errorf("ParseKeyTemplate(%q) succeeded", s)
+		}
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := map[string][3]int{
+		"255:128:0":   {255, 128, 0},
+		" 1: 2: 3":    {1, 2, 3},
+		"256:-1:10":   {0, 0, 10},
+		"red":         {0, 0, 0},
+		"1:2":         {0, 0, 0},
+		"":            {0, 0, 0},
+		"10:twenty:0": {10, 0, 0},
+	}
+
+	for s, want := range tests {
+		if got := ParseColor(s); got != want {
+			t.Errorf("ParseColor(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestColorChannels(t *testing.T) {
+	status := newStatus(switchbot.DeviceStatus{Color: "255:128:0"}, "")
+	for metric, want := range map[*SwitchBotMetric]float64{ColorRed: 255, ColorGreen: 128, ColorBlue: 0} {
+		if !metric.AvailableFunc(status) || metric.ValueFunc(status) != want {
+			t.Errorf("%s = %v, want %v", metric.Name, metric.ValueFunc(status), want)
+		}
+	}
+
+	if ColorRed.AvailableFunc(newStatus(switchbot.DeviceStatus{}, "")) {
+		t.Error("color_red without a color is emitted")
+	}
+}
+
+func TestPowerState(t *testing.T) {
+	tests := map[switchbot.PowerState]float64{"on": 1, "ON": 1, "off": 0}
+
+	for power, want := range tests {
+		status := newStatus(switchbot.DeviceStatus{Power: power}, "")
+		if got := PowerState.ValueFunc(status); got != want {
+			t.Errorf("power %q = %v, want %v", power, got, want)
+		}
+	}
+
+	if PowerState.AvailableFunc(newStatus(switchbot.DeviceStatus{}, "")) {
+		t.Error("missing power is emitted")
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	rt, err := NewTransport("http://proxy.example.com:8080", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := rt.(*http.Transport)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api.switch-bot.com/v1.1/devices", nil)
+	if proxy, err := transport.Proxy(req); err != nil || proxy.String() != "http://proxy.example.com:8080" {
+		t.Errorf("proxy = %v, %v, want http://proxy.example.com:8080", proxy, err)
+	}
+	if transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("certificates are verified with insecure")
+	}
+
+	rt, err = NewTransport("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := rt.(*http.Transport).TLSClientConfig; config != nil && config.InsecureSkipVerify {
+		t.Error("certificates are not verified by default")
+	}
+
+	if _, err := NewTransport("http://proxy.example.com:port", false); err == nil {
+		t.Error("NewTransport succeeded with an invalid proxy")
+	}
+}
+
+func TestResolveDeviceHubs(t *testing.T) {
+	devices := []switchbot.Device{
+		{ID: "H1", Name: "Living Room Hub", Type: switchbot.Hub2, Hub: "000000000000"},
+		{ID: "H2", Name: "リビング", Type: switchbot.HubMini, Hub: "H2"},
+		{ID: "AA", Type: switchbot.Meter, Hub: "H1"},
+		{ID: "BB", Type: switchbot.Meter, Hub: "H2"},
+		{ID: "CC", Type: switchbot.Lock, Hub: "H3"},
+		{ID: "DD", Type: switchbot.PlugMiniJP, Hub: ""},
+	}
+
+	got := ResolveDeviceHubs(devices)
+	want := map[string]string{
+		"H1": NoHub,
+		"H2": NoHub,
+		"AA": "Living_Room_Hub",
+		// hub names sanitizing to nothing and hubs missing from the list fall back to the hub id
+		"BB": "H2",
+		"CC": "H3",
+		"DD": NoHub,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("ResolveDeviceHubs() = %v, want %v", got, want)
+	}
+}
+
+func TestGroupByHubKeyTemplate(t *testing.T) {
+	tmpl, err := ParseKeyTemplate(GroupByHubKeyTemplate, "switchbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.KeyTemplate = tmpl
+	p.DeviceHubs = map[string]string{"AA": "Living_Room_Hub"}
+
+	metrics, _ := p.FetchMetrics()
+	for _, key := range []string{"Living_Room_Hub.AA.battery", "none.BB.battery"} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("%s is missing: %v", key, metrics)
+		}
+	}
+	if names := p.MetricNames(metrics); len(names) != len(metrics) {
+		t.Errorf("%d of %d metrics match a graph", len(names), len(metrics))
+	}
+}
+
+func TestFetchStatusDecodesMismatchedFields(t *testing.T) {
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, `{"deviceId":"AA","deviceType":"Relay Switch 1PM","switchStatus":1,"power":120.5,"voltage":100.2}`)
+	})
+
+	p := SwitchBotPlugin{SwitchBotClient: c, Recorder: recorder}
+	status, err := p.FetchStatus(context.Background(), "AA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Type != "Relay Switch 1PM" || status.Voltage != 100.2 {
+		t.Errorf("status = %+v, want the fields decoding as usual", status.DeviceStatus)
+	}
+	if got := Power.ValueFunc(status); got != 120.5 {
+		t.Errorf("power = %v, want 120.5", got)
+	}
+	if PowerState.AvailableFunc(status) {
+		t.Error("power_state is emitted from the numeric power")
+	}
+}
+
+func TestCirculatorFanStatuses(t *testing.T) {
+	// both fans report "mode" as a string, which go-switchbot decodes as an int
+	bodies := map[string]string{
+		"AA": `{"deviceId":"AA","deviceType":"Circulator Fan","mode":"direct","fanSpeed":50,"oscillation":"on","power":"on"}`,
+		"BB": `{"deviceId":"BB","deviceType":"Battery Circulator Fan","mode":"natural","fanSpeed":30,"battery":80,"power":"off"}`,
+	}
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, bodies[strings.Split(r.URL.Path, "/")[3]])
+	})
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.SwitchBotClient = c
+	p.Recorder = recorder
+	p.Statuses = map[string]*DeviceStatus{}
+	p.Latencies = map[string]time.Duration{}
+
+	if err := p.FetchStatuses(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	want := map[string]float64{
+		"AA.fan_speed":         50,
+		"AA.oscillation_state": 1,
+		"AA.power_state":       1,
+		"BB.fan_speed":         30,
+		"BB.battery":           80,
+		"BB.power_state":       0,
+	}
+	for key, value := range want {
+		if got, ok := metrics[key]; !ok || got != value {
+			t.Errorf("%s = %v (%v), want %v", key, got, ok, value)
+		}
+	}
+}
+
+func TestKeyTemplateDeviceNameFallsBackToID(t *testing.T) {
+	tmpl, err := ParseKeyTemplate("{{.Prefix}}.{{.DeviceName}}.{{.Metric}}", "switchbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPlugin(GraphLayoutFlat)
+	p.KeyTemplate = tmpl
+	p.DeviceNames = map[string]string{"AA": "温湿度計", "BB": "Office"}
+	p.DeviceKeys = ResolveDeviceKeys(p.Targets, p.DeviceNames)
+
+	metrics, _ := p.FetchMetrics()
+	for _, key := range []string{"AA.battery", "Office.battery"} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("%s is missing: %v", key, metrics)
+		}
+	}
+}
+
+func TestFilterDevicesByHub(t *testing.T) {
+	devices := []switchbot.Device{
+		{ID: "H1", Type: switchbot.Hub2, Hub: "000000000000"},
+		{ID: "AA", Type: switchbot.Meter, Hub: "H1"},
+		{ID: "BB", Type: switchbot.Meter, Hub: "H2"},
+		{ID: "CC", Type: switchbot.Lock, Hub: "H1"},
+	}
+
+	got := FilterDevicesByHub([]string{"H1", "AA", "BB", "CC", "IR"}, devices, []string{"H1"})
+	if want := []string{"H1", "AA", "CC"}; !slices.Equal(got, want) {
+		t.Errorf("FilterDevicesByHub() = %v, want %v", got, want)
+	}
+}
+
+func TestFetchDevices(t *testing.T) {
+	c := &fakeClient{listErr: errors.New("unauthorized")}
+	p := SwitchBotPlugin{SwitchBotClient: c, Timeout: time.Second}
+	if _, _, err := p.FetchDevices(context.Background()); err == nil {
+		t.Error("FetchDevices succeeded")
+	}
+}
+
+func TestFetchDevicesRetriesRateLimitedCalls(t *testing.T) {
+	calls := 0
+	c, recorder := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"statusCode":100,"message":"success","body":{"deviceList":[{"deviceId":"AA","deviceName":"Office","deviceType":"Meter","hubDeviceId":"H1"}],"infraredRemoteList":[]}}`)
+	})
+
+	p := SwitchBotPlugin{SwitchBotClient: c, Recorder: recorder, MaxRetries: 2}
+	devices, _, err := p.FetchDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || devices[0].Hub != "H1" || calls != 2 {
+		t.Errorf("devices = %+v after %d calls, want AA after 2", devices, calls)
+	}
+}
+
+func TestResolveDeviceTimeouts(t *testing.T) {
+	timeouts, err := ParseDeviceTimeouts("smart lock=30s, AA=5s, Smart Lock Pro=20s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices := []switchbot.Device{
+		{ID: "AA", Type: switchbot.Lock},
+		{ID: "BB", Type: switchbot.Lock},
+		{ID: "CC", Type: "Smart Lock Pro"},
+		{ID: "DD", Type: switchbot.Meter},
+	}
+	p := SwitchBotPlugin{Timeout: 10 * time.Second, DeviceTimeouts: ResolveDeviceTimeouts(timeouts, devices)}
+
+	tests := map[string]time.Duration{
+		"AA": 5 * time.Second,
+		"BB": 30 * time.Second,
+		"CC": 20 * time.Second,
+		"DD": 10 * time.Second,
+	}
+	for target, want := range tests {
+		if got := p.GetTimeout(target); got != want {
+			t.Errorf("GetTimeout(%q) = %s, want %s", target, got, want)
+		}
+	}
+}
+
+func TestFetchStatusesSkipsDevicesOfUnreachableHubs(t *testing.T) {
+	c := &fakeClient{statuses: map[string]switchbot.DeviceStatus{
+		"AA": {ID: "AA", Type: switchbot.Meter, Battery: 50},
+		"EE": {ID: "EE", Type: switchbot.Meter, Battery: 60},
+	}}
+	p := newTestPlugin(GraphLayoutFlat)
+	p.Targets = []string{"BB", "AA", "CC", "DD", "EE"}
+	p.SwitchBotClient = c
+	p.Statuses = map[string]*DeviceStatus{}
+	p.Latencies = map[string]time.Duration{}
+	p.Concurrency = 1
+	p.HubFailures = 2
+	p.HubIDs = ResolveHubIDs([]switchbot.Device{
+		{ID: "AA", Hub: "H1"},
+		{ID: "BB", Hub: "H2"},
+		{ID: "CC", Hub: "H2"},
+		{ID: "DD", Hub: "H2"},
+		{ID: "EE", Hub: "000000000000"},
+	})
+
+	if err := p.FetchStatuses(context.Background()); err == nil {
+		t.Fatal("FetchStatuses succeeded")
+	}
+
+	if want := []string{"EE", "AA", "BB", "CC"}; !slices.Equal(c.calls, want) {
+		t.Errorf("status calls = %v, want %v", c.calls, want)
+	}
+
+	metrics, _ := p.FetchMetrics()
+	if online, ok := metrics["DD.online"]; !ok || online != 0 {
+		t.Errorf("online of the skipped device = %v (%v), want 0", online, ok)
+	}
+}
+
+func TestMultiAccountClientDeduplicatesDevices(t *testing.T) {
+	first := &fakeClient{
+		statuses: map[string]switchbot.DeviceStatus{"AA": {ID: "AA", Battery: 10}, "BB": {ID: "BB", Battery: 20}},
+		devices:  []switchbot.Device{{ID: "AA"}, {ID: "BB"}},
+		infrared: []switchbot.InfraredDevice{{ID: "IR"}},
+	}
+	second := &fakeClient{
+		statuses: map[string]switchbot.DeviceStatus{"BB": {ID: "BB", Battery: 99}, "CC": {ID: "CC", Battery: 30}},
+		devices:  []switchbot.Device{{ID: "BB"}, {ID: "CC"}},
+		infrared: []switchbot.InfraredDevice{{ID: "IR"}},
+	}
+	c := &MultiAccountClient{Clients: []SwitchBotClient{first, second}}
+
+	devices, infrared, err := c.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 || len(infrared) != 1 {
+		t.Errorf("List() = %v, %v, want every device once", devices, infrared)
+	}
+
+	status, err := c.Status(context.Background(), "BB")
+	if err != nil || status.Battery != 20 {
+		t.Errorf("status of BB = %+v, %v, want the one of the first account", status, err)
+	}
+}
+
+func TestMultiAccountClientListsOnce(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	first := &fakeClient{listErr: errors.New("unauthorized")}
+	second := &fakeClient{
+		statuses: map[string]switchbot.DeviceStatus{"BB": {ID: "BB", Battery: 20}},
+		devices:  []switchbot.Device{{ID: "BB"}},
+	}
+	c := &MultiAccountClient{Clients: []SwitchBotClient{first, second}}
+
+	for range 3 {
+		status, err := c.Status(context.Background(), "BB")
+		if err != nil || status.Battery != 20 {
+			t.Errorf("status of BB = %+v, %v, want the one of the second account", status, err)
+		}
+	}
+	if _, err := c.Status(context.Background(), "AA"); err == nil {
+		t.Error("status of a device of no listed account is fetched")
+	}
+
+	devices, _, err := c.List(context.Background())
+	if err != nil || len(devices) != 1 {
+		t.Errorf("List() = %v, %v, want the devices of the second account", devices, err)
+	}
+
+	for _, client := range []*fakeClient{first, second} {
+		if n := slices.Index(client.calls, "list"); n < 0 || slices.Contains(client.calls[n+1:], "list") {
+			t.Errorf("calls = %v, want the devices listed once", client.calls)
+		}
+	}
+	if !strings.Contains(logs.String(), "failed to list the devices of account 1: unauthorized") {
+		t.Errorf("logs = %q, want the failing account", logs.String())
+	}
+}
+
+func TestMultiAccountClientListFailsForEveryAccount(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	account := &fakeClient{listErr: errors.New("unauthorized")}
+	c := &MultiAccountClient{Clients: []SwitchBotClient{account}}
+
+	if _, _, err := c.List(context.Background()); err == nil {
+		t.Fatal("List() succeeds with every account failing")
+	}
+
+	// a failed listing is retried by List, then reused once it succeeded
+	account.listErr = nil
+	account.devices = []switchbot.Device{{ID: "AA"}}
+	for range 2 {
+		if devices, _, err := c.List(context.Background()); err != nil || len(devices) != 1 {
+			t.Errorf("List() = %v, %v, want the devices once listed", devices, err)
+		}
+	}
+	if n := len(slices.DeleteFunc(slices.Clone(account.calls), func(c string) bool { return c != "list" })); n != 2 {
+		t.Errorf("devices listed %d times, want 2", n)
+	}
+}
+
+func TestMultiAccountClientDuplicates(t *testing.T) {
+	for duplicates, logged := range map[string]bool{DuplicatesWarn: true, DuplicatesFirst: false, "": true} {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+		c := &MultiAccountClient{
+			Clients: []SwitchBotClient{
+				&fakeClient{devices: []switchbot.Device{{ID: "AA"}}},
+				&fakeClient{devices: []switchbot.Device{{ID: "AA"}}},
+			},
+			Duplicates: duplicates,
+		}
+		if _, _, err := c.List(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := strings.Contains(logs.String(), "device AA is listed by account 2 as well"); got != logged {
+			t.Errorf("duplicate logged with %q = %v, want %v", duplicates, got, logged)
+		}
+	}
+}
+
+func TestAddDailyCalls(t *testing.T) {
+	path := DailyCallsPath(filepath.Join(t.TempDir(), "mackerel-plugin-switchbot"), "token")
+	day := time.Date(2026, 1, 2, 23, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		now   time.Time
+		calls int
+		want  int
+	}{
+		{day, 3, 3},
+		{day.Add(30 * time.Minute), 2, 5},
+		// 00:30 UTC is a new day even if it is still the 2nd in the local time zone
+		{day.Add(90 * time.Minute).In(time.FixedZone("", -5*60*60)), 4, 4},
+	} {
+		got, err := AddDailyCalls(path, tt.calls, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("AddDailyCalls(%d) at %s = %d, want %d", tt.calls, tt.now, got, tt.want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := AddDailyCalls(path, 1, day); err != nil || got != 1 {
+		t.Errorf("AddDailyCalls on a broken file = %d, %v, want 1", got, err)
+	}
+
+	if other := DailyCallsPath(filepath.Join(filepath.Dir(path), "x"), "other"); other == path {
+		t.Errorf("DailyCallsPath is %s for another token as well", other)
+	}
+}
+
+func TestOutputCallsToday(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		p := newTestPlugin(GraphLayoutFlat)
+		p.CallsToday = 42
+
+		out := captureStdout(t, func() {
+			if err := p.Output(filepath.Join(t.TempDir(), "tempfile"), buffered); err != nil {
+				t.Error(err)
+			}
+		})
+
+		if got := parseValues(t, out)["switchbot.meta.api_calls_today"]; got != 42 {
+			t.Errorf("buffered %v: api_calls_today = %v, want 42", buffered, got)
+		}
+	}
+}
+
+func TestDashboardFromDeviceTypes(t *testing.T) {
+	for _, layout := range []string{GraphLayoutFlat, GraphLayoutGrouped, GraphLayoutUnit, GraphLayoutDevice} {
+		p := newTestPlugin(layout)
+		want := p.BuildDashboard("host")
+
+		p.Statuses = DeviceTypeStatuses(p.Targets, []switchbot.Device{
+			{ID: "AA", Type: switchbot.Meter},
+			{ID: "BB", Type: switchbot.MeterProCO2},
+			{ID: "ZZ", Type: switchbot.Lock},
+		})
+		if len(p.Statuses) != 2 {
+			t.Errorf("DeviceTypeStatuses() = %v, want AA and BB", p.Statuses)
+		}
+
+		if got := p.BuildDashboard("host"); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: dashboard from device types = %+v, want %+v", layout, got, want)
+		}
+	}
+}
+
+func TestFilterLife(t *testing.T) {
+	tests := map[string]float64{
+		`{"filterElement": {"effectiveUsageHours": 720, "usedHours": 180}}`: 75,
+		`{"filterElement": {"effectiveUsageHours": 720, "usedHours": 900}}`: 0,
+	}
+
+	for raw, want := range tests {
+		status := newStatus(switchbot.DeviceStatus{Type: "Humidifier2"}, raw)
+		if !FilterLife.AvailableFunc(status) || FilterLife.ValueFunc(status) != want {
+			t.Errorf("filter_life of %s = %v, want %v", raw, FilterLife.ValueFunc(status), want)
+		}
+	}
+
+	for _, raw := range []string{`{"humidity": 40}`, `{"filterElement": {"usedHours": 10}}`} {
+		if FilterLife.AvailableFunc(newStatus(switchbot.DeviceStatus{Type: "Humidifier2"}, raw)) {
+			t.Errorf("filter_life of %s is emitted", raw)
+		}
+	}
+}
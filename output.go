@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/nasa9084/go-switchbot/v4"
+)
+
+// Output runs p through go-mackerel-plugin, buffering its output with buffered.
+// The helper keeps a copy of p, so it is only built here, once p is complete.
+func (p SwitchBotPlugin) Output(tempfile string, buffered bool) error {
+	helper := mp.NewMackerelPlugin(p)
+	helper.Tempfile = tempfile
+
+	if buffered {
+		return RunBuffered(helper)
+	}
+
+	helper.Run()
+	return nil
+}
+
+// RunBuffered runs helper with its stdout collected in memory, then writes the whole output at once.
+// go-mackerel-plugin writes one line per metric to os.Stdout, so os.Stdout is swapped for a pipe while it runs.
+func RunBuffered(helper *mp.MackerelPlugin) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(&buf, r)
+		done <- err
+	}()
+
+	helper.Run()
+
+	w.Close()
+	if err := <-done; err != nil {
+		return err
+	}
+
+	_, err = stdout.Write(buf.Bytes())
+	return err
+}
+
+// MetricNames returns metrics keyed by the full names go-mackerel-plugin outputs them as, without diff metrics.
+func (p SwitchBotPlugin) MetricNames(metrics map[string]float64) map[string]float64 {
+	names := map[string]float64{}
+
+	for key, graph := range p.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			if metric.Diff {
+				continue
+			}
+
+			if !strings.ContainsAny(key+metric.Name, "*#") {
+				if value, ok := metrics[metric.Name]; ok {
+					names[key+"."+metric.Name] = value
+				}
+				continue
+			}
+
+			re := WildcardRegexp(key + "." + metric.Name)
+			for name, value := range metrics {
+				if re.MatchString(name) {
+					names[name] = value
+				}
+			}
+		}
+	}
+
+	return names
+}
+
+// WildcardRegexp returns the regexp go-mackerel-plugin matches metric names against for a wildcard metric name.
+func WildcardRegexp(name string) *regexp.Regexp {
+	expr := `\A` + strings.ReplaceAll(name, ".", `\.`)
+	expr = strings.NewReplacer("*", `[-a-zA-Z0-9_]+`, "#", `[-a-zA-Z0-9_]+`).Replace(expr)
+	return regexp.MustCompile(expr)
+}
+
+// WriteDevicesTable writes the id, type and name of devices as an aligned table.
+func WriteDevicesTable(w io.Writer, devices []switchbot.Device) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tNAME")
+	for _, device := range devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", device.ID, device.Type, device.Name)
+	}
+
+	return tw.Flush()
+}
+
+type listedDevice struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// WriteDevicesJSON writes the id, type and name of devices as a json array.
+func WriteDevicesJSON(w io.Writer, devices []switchbot.Device) error {
+	listed := []listedDevice{}
+	for _, device := range devices {
+		listed = append(listed, listedDevice{ID: device.ID, Type: string(device.Type), Name: device.Name})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(listed)
+}
+
+var prometheusNameReplacer = strings.NewReplacer("-", "_", ".", "_")
+
+var prometheusLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type prometheusFamily struct {
+	help    string
+	samples []string
+}
+
+// WritePrometheus writes the metrics in the prometheus text exposition format.
+// Device metrics are named "<prefix>_<metric>" and labeled with device_id and device_type, regardless of the graph layout.
+func (p SwitchBotPlugin) WritePrometheus(w io.Writer) error {
+	prefix := prometheusNameReplacer.Replace(p.GetPrefix())
+	families := map[string]*prometheusFamily{}
+	names := []string{}
+
+	add := func(name, help, sample string) {
+		family, ok := families[name]
+		if !ok {
+			family = &prometheusFamily{help: help}
+			families[name] = family
+			names = append(names, name)
+		}
+		family.samples = append(family.samples, sample)
+	}
+
+	for _, target := range p.Targets {
+		// the type of a device whose status call failed is unknown
+		var deviceType switchbot.PhysicalDeviceType
+		if status, ok := p.Statuses[target]; ok {
+			deviceType = status.Type
+		}
+
+		for _, v := range p.DeviceMetrics(target) {
+			// prometheus computes rates itself; the raw value of a Diff metric is its counter
+			if v.Metric.Diff {
+				continue
+			}
+
+			name := fmt.Sprintf("%s_%s", prefix, v.Metric.Name)
+			labels := fmt.Sprintf(`device_id="%s",device_type="%s"`, prometheusLabelReplacer.Replace(target), prometheusLabelReplacer.Replace(string(deviceType)))
+			add(name, v.Metric.Label, fmt.Sprintf("%s{%s} %v", name, labels, v.Value))
+		}
+	}
+
+	meta := p.MetaMetrics()
+	for _, key := range slices.Sorted(maps.Keys(meta)) {
+		name := fmt.Sprintf("%s_%s", prefix, key)
+		add(name, fmt.Sprintf("SwitchBot Plugin (%s)", key), fmt.Sprintf("%s %v", name, meta[key]))
+	}
+
+	for _, name := range names {
+		family := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, sample := range family.samples {
+			if _, err := fmt.Fprintln(w, sample); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type metricsDump struct {
+	Metrics     map[string]float64 `json:"metrics"`
+	DeviceTypes map[string]string  `json:"device_types"`
+}
+
+// WriteJSON writes the metrics returned by FetchMetrics along with the type of each fetched device as indented json.
+func (p SwitchBotPlugin) WriteJSON(w io.Writer) error {
+	metrics, err := p.FetchMetrics()
+	if err != nil {
+		return err
+	}
+
+	types := map[string]string{}
+	for target, status := range p.Statuses {
+		types[target] = string(status.Type)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(metricsDump{Metrics: metrics, DeviceTypes: types})
+}
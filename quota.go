@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DailyCalls is the number of api calls made on a day (UTC), persisted across runs
+// because the switchbot api limits the calls per account and day.
+type DailyCalls struct {
+	Date  string `json:"date"`
+	Calls int    `json:"calls"`
+}
+
+// DailyCallsPath returns the file persisting DailyCalls for the accounts of token, next to the go-mackerel-plugin
+// tempfile (in the plugin work directory when it is not given). Runs with the same token share the file.
+func DailyCallsPath(tempfile, token string) string {
+	dir := filepath.Dir(tempfile)
+	if tempfile == "" {
+		dir = os.Getenv("MACKEREL_PLUGIN_WORKDIR")
+		if dir == "" {
+			dir = os.TempDir()
+		}
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return filepath.Join(dir, fmt.Sprintf("mackerel-plugin-switchbot-calls-%x.json", sum[:4]))
+}
+
+// AddDailyCalls adds calls made at now to the count persisted in path, starting over on a new UTC day,
+// and returns the count of the day. Runs finishing at the same moment may lose one another's calls.
+func AddDailyCalls(path string, calls int, now time.Time) (int, error) {
+	today := now.UTC().Format(time.DateOnly)
+
+	var daily DailyCalls
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	if err == nil {
+		// a broken file starts the count over rather than disabling it for good
+		_ = json.Unmarshal(b, &daily)
+	}
+
+	if daily.Date != today {
+		daily = DailyCalls{Date: today}
+	}
+	daily.Calls += calls
+
+	b, err = json.Marshal(daily)
+	if err != nil {
+		return 0, err
+	}
+
+	// the file is replaced by a rename, so a concurrent run never reads it half written
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return daily.Calls, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const MackerelEndpoint = "https://api.mackerelio.com"
+
+// ServicePoster posts metric values to a Mackerel service in addition to the host metrics.
+type ServicePoster struct {
+	APIKey      string
+	ServiceName string
+	MetricNames []string
+	HTTPClient  *http.Client
+}
+
+type serviceMetricValue struct {
+	Name  string  `json:"name"`
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+}
+
+// Selected reports whether the metric named name should be posted to the service.
+// All metrics are selected when MetricNames is empty.
+func (s ServicePoster) Selected(name string) bool {
+	if len(s.MetricNames) == 0 {
+		return true
+	}
+
+	for _, segment := range strings.Split(name, ".") {
+		for _, name := range s.MetricNames {
+			if segment == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Post posts metrics, keyed by their full names, to the service.
+func (s ServicePoster) Post(metrics map[string]float64, now time.Time) error {
+	values := []serviceMetricValue{}
+
+	for name, value := range metrics {
+		if !s.Selected(name) {
+			continue
+		}
+
+		values = append(values, serviceMetricValue{
+			Name:  name,
+			Time:  now.Unix(),
+			Value: value,
+		})
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v0/services/%s/tsdb", MackerelEndpoint, url.PathEscape(s.ServiceName)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", s.APIKey)
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to post service metrics: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}